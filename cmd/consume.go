@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/StackExchange/haproxy-kubefigurator/haproxyconfigurator"
+)
+
+// consumeCmd represents the consume command
+var consumeCmd = &cobra.Command{
+	Use:   "consume",
+	Short: "Watch etcd for configuration changes, then check and reload haproxy",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		haproxyconfigurator.Consume(commandLineFlags.etcd, haproxyconfigurator.ConsumerConfig{
+			ConfigPath:     commandLineFlags.haproxyConfig,
+			HaproxyBinary:  commandLineFlags.haproxyBinary,
+			BaseConfigPath: commandLineFlags.haproxyBaseConfig,
+			ReloadCommand:  commandLineFlags.restartCommand,
+			CertificateDir: commandLineFlags.generator.CertificateDir,
+		})
+	},
+}
+
+func init() {
+	consumeCmd.Flags().StringVarP(&commandLineFlags.haproxyBinary, "haproxy-binary", "", "/usr/local/sbin/haproxy", "HAProxy binary used to check configurations before reloading")
+	consumeCmd.Flags().StringVarP(&commandLineFlags.haproxyBaseConfig, "haproxy-base-config", "", "/etc/haproxy/haproxy.cfg", "Main HAProxy configuration checked together with the dynamic configuration; leave empty to check the dynamic configuration alone")
+	RootCmd.AddCommand(consumeCmd)
+}
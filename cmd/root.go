@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"os"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -12,11 +13,15 @@ import (
 var teardown = func() {}
 
 var commandLineFlags = struct {
-	clusterName    string
-	kubeconfig     string
-	verbosity      int
-	haproxyConfig  string
-	restartCommand string
+	kubeconfig        string
+	verbosity         int
+	haproxyConfig     string
+	restartCommand    string
+	etcd              haproxyconfigurator.EtcdConfig
+	haproxyBinary     string
+	haproxyBaseConfig string
+	resyncPeriod      time.Duration
+	generator         haproxyconfigurator.GeneratorOptions
 }{}
 var logger = logrus.New()
 
@@ -39,11 +44,32 @@ func Execute() {
 }
 
 func init() {
-	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.clusterName, "cluster", "", "", "Cluster string for scoped services")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.generator.ClusterName, "cluster", "", "", "Cluster string for scoped services")
 	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.kubeconfig, "kubeconfig", "", "", "Kubeconfig file path; leave empty for in-cluster config")
 	RootCmd.PersistentFlags().CountVarP(&commandLineFlags.verbosity, "verbosity", "v", "Output verbosity")
 	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.haproxyConfig, "haproxy-config", "", "dynamic.cfg", "Location of HAProxy configuration file to generate")
 	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.restartCommand, "exec", "", "systemctl restart haproxy", "Command to execute after config is updated")
+	RootCmd.PersistentFlags().BoolVarP(&commandLineFlags.generator.ManageLoadBalancers, "manage-load-balancers", "", false, "Configure every service of type LoadBalancer and write its addresses to the service status")
+	RootCmd.PersistentFlags().StringSliceVarP(&commandLineFlags.generator.LoadBalancerAddresses, "load-balancer-address", "", []string{}, "IP or hostname reported for LoadBalancer services listening on all IPs without a hostname; may be repeated")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.generator.CertificateDir, "certificate-dir", "", "/etc/haproxy/ssl", "Directory haproxy loads certificates from; certificates synced from secrets are written here")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.generator.HaproxyVersion, "haproxy-version", "", "2.0", "HAProxy version (1.8 or newer) the generated configuration must be valid for")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.generator.SSLDefaults.MinVersion, "ssl-min-ver", "", "", "Oldest TLS version accepted by TLS frontends unless overridden by the ssl-min-ver annotation; leave empty for haproxy's default")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.generator.SSLDefaults.ALPN, "ssl-alpn", "", "", "ALPN protocols offered by TLS frontends (e.g. h2,http/1.1) unless overridden by the ssl-alpn annotation")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.generator.SSLDefaults.Ciphers, "ssl-ciphers", "", "", "OpenSSL cipher list of TLS frontends for TLSv1.2 and older unless overridden by the ssl-ciphers annotation")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.generator.SSLDefaults.Ciphersuites, "ssl-ciphersuites", "", "", "TLSv1.3 cipher suites of TLS frontends (haproxy 1.9 or newer) unless overridden by the ssl-ciphersuites annotation")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.generator.TemplatePath, "template", "", "", "Go text/template file to render the configuration with; leave empty for the built-in layout")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.generator.IngressClass, "ingress-class", "", "", "Generate frontends from ingresses annotated with this kubernetes.io/ingress.class; leave empty to ignore ingresses")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.generator.NodeFilter.Selector, "node-selector", "", "", "Label selector for nodes used as backend targets (e.g. node-role/ingress=true)")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.generator.BackendTargets, "backend-targets", "", "nodeport", "Default backend targets for services: 'nodeport' for node IPs, 'endpoints' for pod IPs")
+	RootCmd.PersistentFlags().BoolVarP(&commandLineFlags.generator.NodeFilter.IncludeNotReady, "include-not-ready-nodes", "", false, "Use nodes that are not Ready as backend targets, ignoring their node.kubernetes.io/not-ready and node.kubernetes.io/unreachable taints unless --exclude-node-taint names them")
+	RootCmd.PersistentFlags().BoolVarP(&commandLineFlags.generator.NodeFilter.ExcludeCordoned, "exclude-cordoned-nodes", "", false, "Do not use cordoned (unschedulable) nodes as backend targets")
+	RootCmd.PersistentFlags().StringSliceVarP(&commandLineFlags.generator.NodeFilter.ExcludeTaints, "exclude-node-taint", "", []string{":NoExecute"}, "Do not use nodes carrying a matching taint (key[=value][:effect] or :effect) as backend targets; may be repeated")
+	RootCmd.PersistentFlags().DurationVarP(&commandLineFlags.resyncPeriod, "resync-period", "", 10*time.Minute, "How often watched kubernetes objects are fully re-listed; 0 disables resyncing")
+	RootCmd.PersistentFlags().StringSliceVarP(&commandLineFlags.etcd.Hosts, "etcd-host", "", []string{}, "etcd endpoint to publish configuration to; may be repeated. Leave empty to write --haproxy-config locally")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.etcd.Path, "etcd-path", "", "/stackexchange.com/haproxy-kubefigurator/config", "etcd key to store the generated configuration in")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.etcd.CaFile, "etcd-ca-file", "", "", "CA certificate used to verify the etcd servers")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.etcd.ClientCertFile, "etcd-client-cert-file", "", "", "Client certificate used to authenticate against etcd")
+	RootCmd.PersistentFlags().StringVarP(&commandLineFlags.etcd.ClientKeyFile, "etcd-client-key-file", "", "", "Client key used to authenticate against etcd")
 }
 
 func persistentPreRun(cmd *cobra.Command, args []string) {
@@ -0,0 +1,132 @@
+package haproxyconfigurator
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+// basicAuthSecretKey is the key of the htpasswd file in basic authentication secrets
+const basicAuthSecretKey = "auth"
+
+const defaultBasicAuthRealm = "Restricted"
+
+// secretAnnotations are the service and ingress annotations that name a secret of the same namespace
+var secretAnnotations = []string{"auth-secret", "tls-secret", "client-ca-secret"}
+
+// configMapAnnotations are the service and ingress annotations that name a config map of the same namespace
+var configMapAnnotations = []string{"client-ca-configmap"}
+
+var basicAuthRealmPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// cryptHashPattern matches the crypt(3) hashes haproxy checks passwords against
+var cryptHashPattern = regexp.MustCompile(`^[A-Za-z0-9./$]+$`)
+
+// basicAuth builds the basic authentication of a service port or ingress from the secret named by
+// the auth-secret annotation read through anno, or returns nil without one
+func basicAuth(cache *kubernetesCache, namespace string, anno func(name string) string) (*HaproxyBasicAuth, error) {
+	secretName := anno("auth-secret")
+	if secretName == "" {
+		return nil, nil
+	}
+	var auth = &HaproxyBasicAuth{Realm: defaultBasicAuthRealm}
+	if realm := anno("auth-realm"); realm != "" {
+		if !basicAuthRealmPattern.MatchString(realm) {
+			return nil, errors.New("Invalid auth-realm (" + realm + ") specified - only letters, digits, '.', '-' and '_' are allowed")
+		}
+		auth.Realm = realm
+	}
+
+	secret, exists, err := cache.getSecret(namespace, secretName)
+	if err != nil {
+		return nil, errors.New("Cannot read secret " + namespace + "/" + secretName + ": " + err.Error())
+	}
+	if !exists {
+		return nil, errors.New("Secret " + namespace + "/" + secretName + " does not exist")
+	}
+	htpasswd, exists := secret.Data[basicAuthSecretKey]
+	if !exists {
+		return nil, errors.New("Secret " + namespace + "/" + secretName + " has no " + basicAuthSecretKey + " key")
+	}
+	users, err := parseHtpasswd(string(htpasswd))
+	if err != nil {
+		return nil, errors.New("Secret " + namespace + "/" + secretName + ": " + err.Error())
+	}
+	auth.Userlist = &HaproxyUserlist{
+		Name:  "k8s-secret_" + namespace + "_" + secretName + "_users",
+		Users: users,
+	}
+	return auth, nil
+}
+
+// parseHtpasswd reads user:hash lines, skipping blank lines and comments
+func parseHtpasswd(htpasswd string) ([]HaproxyUser, error) {
+	var users = []HaproxyUser{}
+	for _, line := range strings.Split(htpasswd, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[0], " \t") {
+			return nil, errors.New("Invalid htpasswd line for user (" + parts[0] + ") - expected <user>:<hash>")
+		}
+		if strings.HasPrefix(parts[1], "$apr1$") || strings.HasPrefix(parts[1], "{SHA}") || !cryptHashPattern.MatchString(parts[1]) {
+			return nil, errors.New("Unsupported password hash for user (" + parts[0] + ") - haproxy only checks crypt(3) hashes like those of 'mkpasswd -m sha-512'")
+		}
+		users = append(users, HaproxyUser{Name: parts[0], Password: parts[1]})
+	}
+	if len(users) == 0 {
+		return nil, errors.New("No users found in " + basicAuthSecretKey)
+	}
+	return users, nil
+}
+
+// secretReferenced reports whether a proxied service or an ingress of the configured class uses the secret
+func secretReferenced(cache *kubernetesCache, secret *v1.Secret, options GeneratorOptions) bool {
+	if annotationReferenced(cache, secret.Namespace, secret.Name, secretAnnotations, options) {
+		return true
+	}
+	for _, ing := range cache.listIngresses() {
+		if ing.Namespace != secret.Namespace || !ingressMatchesClass(ing, options) {
+			continue
+		}
+		for _, tls := range ing.Spec.TLS {
+			if tls.SecretName == secret.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// annotationReferenced reports whether one of the annotations of a proxied service or an ingress of the
+// configured class in the namespace names the object
+func annotationReferenced(cache *kubernetesCache, namespace string, name string, annotations []string, options GeneratorOptions) bool {
+	for _, svc := range getProxiedKubernetesServices(cache, options) {
+		if svc.Namespace != namespace {
+			continue
+		}
+		service := serviceWrapper(svc)
+		for _, p := range service.Spec.Ports {
+			for _, annotation := range annotations {
+				if service.anno(servicePortWrapper(p), annotation) == name {
+					return true
+				}
+			}
+		}
+	}
+	for _, ing := range cache.listIngresses() {
+		if ing.Namespace != namespace || !ingressMatchesClass(ing, options) {
+			continue
+		}
+		for _, annotation := range annotations {
+			if ingressWrapper(*ing).anno(annotation) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
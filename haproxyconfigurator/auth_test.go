@@ -0,0 +1,43 @@
+package haproxyconfigurator
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHtpasswd(t *testing.T) {
+	const sha512 = "$6$saltsalt$qFmFH.bQmmtXzyBY0s9v7Oicd2z4XSIecDzlB5KiA2/jctKu9YterLp8wwnSq.qc.eoxqOmSuNp2xS0ktL3nh/"
+	for _, test := range []struct {
+		name     string
+		htpasswd string
+		expected []HaproxyUser
+		invalid  bool
+	}{
+		{"single user", "alice:" + sha512, []HaproxyUser{{Name: "alice", Password: sha512}}, false},
+		{"comments and blank lines", "# users\n\nalice:" + sha512 + "\n  bob:" + sha512 + "  \n",
+			[]HaproxyUser{{Name: "alice", Password: sha512}, {Name: "bob", Password: sha512}}, false},
+		{"des", "alice:rl0uE5SKpKQvA", []HaproxyUser{{Name: "alice", Password: "rl0uE5SKpKQvA"}}, false},
+		{"apr1", "alice:$apr1$salt$hash", nil, true},
+		{"sha1", "alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", nil, true},
+		{"missing hash", "alice", nil, true},
+		{"missing user", ":" + sha512, nil, true},
+		{"user with space", "al ice:" + sha512, nil, true},
+		{"empty", "\n# nobody\n", nil, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			users, err := parseHtpasswd(test.htpasswd)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", users)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(users, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, users)
+			}
+		})
+	}
+}
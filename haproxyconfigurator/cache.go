@@ -0,0 +1,442 @@
+package haproxyconfigurator
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// changeHandler is called for every change applied to an objectStore.  old is nil for additions.
+type changeHandler func(eventType watch.EventType, old runtime.Object, obj runtime.Object)
+
+// objectStore keeps a local copy of one kind of kubernetes object, kept current by a list and watch
+type objectStore struct {
+	kind            string
+	list            func(metav1.ListOptions) (runtime.Object, error)
+	watch           func(metav1.ListOptions) (watch.Interface, error)
+	resyncPeriod    time.Duration
+	onChange        changeHandler
+	mutex           sync.RWMutex
+	objects         map[string]runtime.Object
+	resourceVersion string
+}
+
+func objectKey(obj runtime.Object) (string, string, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return "", "", err
+	}
+	key := accessor.GetName()
+	if accessor.GetNamespace() != "" {
+		key = accessor.GetNamespace() + "/" + key
+	}
+	return key, accessor.GetResourceVersion(), nil
+}
+
+func (s *objectStore) notify(eventType watch.EventType, old runtime.Object, obj runtime.Object) {
+	if s.onChange != nil {
+		s.onChange(eventType, old, obj)
+	}
+}
+
+// relist replaces the store contents with a full listing and notifies about any differences
+func (s *objectStore) relist() error {
+	list, err := s.list(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	listMeta, err := meta.ListAccessor(list)
+	if err != nil {
+		return err
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+	objects := make(map[string]runtime.Object, len(items))
+	for _, item := range items {
+		key, _, err := objectKey(item)
+		if err != nil {
+			return err
+		}
+		objects[key] = item
+	}
+
+	s.mutex.Lock()
+	previous := s.objects
+	s.objects = objects
+	s.resourceVersion = listMeta.GetResourceVersion()
+	s.mutex.Unlock()
+
+	logger.Debugf("Listed %d %s at resourceVersion %s", len(objects), s.kind, listMeta.GetResourceVersion())
+	for key, obj := range objects {
+		old, exists := previous[key]
+		if !exists {
+			s.notify(watch.Added, nil, obj)
+			continue
+		}
+		_, oldVersion, _ := objectKey(old)
+		_, newVersion, _ := objectKey(obj)
+		if oldVersion != newVersion {
+			s.notify(watch.Modified, old, obj)
+		}
+	}
+	for key, old := range previous {
+		if _, exists := objects[key]; !exists {
+			s.notify(watch.Deleted, old, old)
+		}
+	}
+	return nil
+}
+
+// apply records a single watch event in the store
+func (s *objectStore) apply(event watch.Event) error {
+	key, resourceVersion, err := objectKey(event.Object)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	old := s.objects[key]
+	if event.Type == watch.Deleted {
+		delete(s.objects, key)
+	} else {
+		s.objects[key] = event.Object
+	}
+	s.resourceVersion = resourceVersion
+	s.mutex.Unlock()
+
+	s.notify(event.Type, old, event.Object)
+	return nil
+}
+
+// run keeps the store current until the process exits.  The store must have been listed first.
+func (s *objectStore) run() {
+	for {
+		s.mutex.RLock()
+		resourceVersion := s.resourceVersion
+		s.mutex.RUnlock()
+
+		if resourceVersion == "" {
+			if err := s.relist(); err != nil {
+				logger.Error(err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+
+		start := time.Now()
+		logger.Debugf("Watching for %s changes from resourceVersion %s", s.kind, resourceVersion)
+		w, err := s.watch(metav1.ListOptions{ResourceVersion: resourceVersion})
+		if err != nil {
+			logger.Error(err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if s.watchUntilResync(w) {
+			logger.Debugf("Resyncing %s", s.kind)
+			s.forgetResourceVersion()
+		}
+		logger.Infof("Watch for %s closed after %s", s.kind, time.Now().Sub(start))
+	}
+}
+
+// watchUntilResync applies watch events until the watch closes, expires or the resync period passes.
+// It returns true when the store needs to be listed again.
+func (s *objectStore) watchUntilResync(w watch.Interface) bool {
+	defer w.Stop()
+	var resync <-chan time.Time
+	if s.resyncPeriod > 0 {
+		timer := time.NewTimer(s.resyncPeriod)
+		defer timer.Stop()
+		resync = timer.C
+	}
+	for {
+		select {
+		case <-resync:
+			return true
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return false
+			}
+			if event.Type == watch.Error {
+				err := apierrors.FromObject(event.Object)
+				if apierrors.IsGone(err) || apierrors.IsResourceExpired(err) {
+					logger.Infof("Watch for %s expired: %s", s.kind, err)
+					return true
+				}
+				logger.Error(err)
+				return false
+			}
+			if err := s.apply(event); err != nil {
+				logger.Error(err)
+			}
+		}
+	}
+}
+
+func (s *objectStore) forgetResourceVersion() {
+	s.mutex.Lock()
+	s.resourceVersion = ""
+	s.mutex.Unlock()
+}
+
+func (s *objectStore) get(key string) (runtime.Object, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	obj, exists := s.objects[key]
+	return obj, exists
+}
+
+// all returns the stored objects sorted by key for determinism
+func (s *objectStore) all() []runtime.Object {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	objects := make([]runtime.Object, 0, len(keys))
+	for _, key := range keys {
+		objects = append(objects, s.objects[key])
+	}
+	return objects
+}
+
+// lazyStore is an objectStore that is only listed when first read, and then watched once the cache
+// runs, so that clusters not using its kind need no access to it and keep no copy of it
+type lazyStore struct {
+	mutex    sync.Mutex
+	newStore func() *objectStore
+	store    *objectStore
+	running  bool
+	// onChange is handed to the store after its first listing, which is not reported
+	onChange changeHandler
+}
+
+// get lists the store on first use; a failed listing is retried by the next get
+func (l *lazyStore) get(key string) (runtime.Object, bool, error) {
+	l.mutex.Lock()
+	if l.store == nil {
+		store := l.newStore()
+		if err := store.relist(); err != nil {
+			l.mutex.Unlock()
+			return nil, false, err
+		}
+		store.onChange = l.onChange
+		l.store = store
+		if l.running {
+			go store.run()
+		}
+	}
+	store := l.store
+	l.mutex.Unlock()
+
+	obj, exists := store.get(key)
+	return obj, exists, nil
+}
+
+// run watches the store in the background once it is listed
+func (l *lazyStore) run() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.running = true
+	if l.store != nil {
+		go l.store.run()
+	}
+}
+
+// kubernetesCache holds the cluster state used to generate configurations so that
+// regenerating does not need to query the API server
+type kubernetesCache struct {
+	nodes     *objectStore
+	services  *objectStore
+	endpoints *objectStore
+	// secrets are only listed once a service or ingress references one
+	secrets *lazyStore
+	// configMaps hold the client certificate CA bundles; they are only listed once one is referenced
+	configMaps *lazyStore
+	// ingresses is only kept when an ingress class is configured
+	ingresses *objectStore
+}
+
+func newKubernetesCache(client *kubernetes.Clientset, resyncPeriod time.Duration, options GeneratorOptions) *kubernetesCache {
+	cache := &kubernetesCache{
+		nodes: &objectStore{
+			kind: "nodes",
+			list: func(o metav1.ListOptions) (runtime.Object, error) {
+				return client.CoreV1().Nodes().List(o)
+			},
+			watch: func(o metav1.ListOptions) (watch.Interface, error) {
+				return client.CoreV1().Nodes().Watch(o)
+			},
+			resyncPeriod: resyncPeriod,
+		},
+		services: &objectStore{
+			kind: "services",
+			list: func(o metav1.ListOptions) (runtime.Object, error) {
+				return client.CoreV1().Services(v1.NamespaceAll).List(o)
+			},
+			watch: func(o metav1.ListOptions) (watch.Interface, error) {
+				return client.CoreV1().Services(v1.NamespaceAll).Watch(o)
+			},
+			resyncPeriod: resyncPeriod,
+		},
+		endpoints: &objectStore{
+			kind: "endpoints",
+			list: func(o metav1.ListOptions) (runtime.Object, error) {
+				return client.CoreV1().Endpoints(v1.NamespaceAll).List(o)
+			},
+			watch: func(o metav1.ListOptions) (watch.Interface, error) {
+				return client.CoreV1().Endpoints(v1.NamespaceAll).Watch(o)
+			},
+			resyncPeriod: resyncPeriod,
+		},
+		secrets: &lazyStore{
+			newStore: func() *objectStore {
+				return &objectStore{
+					kind: "secrets",
+					list: func(o metav1.ListOptions) (runtime.Object, error) {
+						return client.CoreV1().Secrets(v1.NamespaceAll).List(o)
+					},
+					watch: func(o metav1.ListOptions) (watch.Interface, error) {
+						return client.CoreV1().Secrets(v1.NamespaceAll).Watch(o)
+					},
+					resyncPeriod: resyncPeriod,
+				}
+			},
+		},
+		configMaps: &lazyStore{
+			newStore: func() *objectStore {
+				return &objectStore{
+					kind: "configmaps",
+					list: func(o metav1.ListOptions) (runtime.Object, error) {
+						return client.CoreV1().ConfigMaps(v1.NamespaceAll).List(o)
+					},
+					watch: func(o metav1.ListOptions) (watch.Interface, error) {
+						return client.CoreV1().ConfigMaps(v1.NamespaceAll).Watch(o)
+					},
+					resyncPeriod: resyncPeriod,
+				}
+			},
+		},
+	}
+	if options.IngressClass != "" {
+		cache.ingresses = &objectStore{
+			kind: "ingresses",
+			list: func(o metav1.ListOptions) (runtime.Object, error) {
+				return client.ExtensionsV1beta1().Ingresses(v1.NamespaceAll).List(o)
+			},
+			watch: func(o metav1.ListOptions) (watch.Interface, error) {
+				return client.ExtensionsV1beta1().Ingresses(v1.NamespaceAll).Watch(o)
+			},
+			resyncPeriod: resyncPeriod,
+		}
+	}
+	return cache
+}
+
+func (c *kubernetesCache) stores() []*objectStore {
+	stores := []*objectStore{c.nodes, c.services, c.endpoints}
+	if c.ingresses != nil {
+		stores = append(stores, c.ingresses)
+	}
+	return stores
+}
+
+// sync lists every store once
+func (c *kubernetesCache) sync() error {
+	for _, store := range c.stores() {
+		if err := store.relist(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run watches every store in the background
+func (c *kubernetesCache) run() {
+	for _, store := range c.stores() {
+		go store.run()
+	}
+	c.secrets.run()
+	c.configMaps.run()
+}
+
+func (c *kubernetesCache) listNodes() []*v1.Node {
+	nodes := []*v1.Node{}
+	for _, obj := range c.nodes.all() {
+		if node, ok := obj.(*v1.Node); ok {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func (c *kubernetesCache) listServices() []*v1.Service {
+	services := []*v1.Service{}
+	for _, obj := range c.services.all() {
+		if service, ok := obj.(*v1.Service); ok {
+			services = append(services, service)
+		}
+	}
+	return services
+}
+
+func (c *kubernetesCache) listIngresses() []*extensionsv1beta1.Ingress {
+	ingresses := []*extensionsv1beta1.Ingress{}
+	if c.ingresses == nil {
+		return ingresses
+	}
+	for _, obj := range c.ingresses.all() {
+		if ingress, ok := obj.(*extensionsv1beta1.Ingress); ok {
+			ingresses = append(ingresses, ingress)
+		}
+	}
+	return ingresses
+}
+
+func (c *kubernetesCache) getService(namespace string, name string) (*v1.Service, bool) {
+	obj, exists := c.services.get(namespace + "/" + name)
+	if !exists {
+		return nil, false
+	}
+	service, ok := obj.(*v1.Service)
+	return service, ok
+}
+
+func (c *kubernetesCache) getEndpoints(namespace string, name string) (*v1.Endpoints, bool) {
+	obj, exists := c.endpoints.get(namespace + "/" + name)
+	if !exists {
+		return nil, false
+	}
+	endpoints, ok := obj.(*v1.Endpoints)
+	return endpoints, ok
+}
+
+func (c *kubernetesCache) getSecret(namespace string, name string) (*v1.Secret, bool, error) {
+	obj, exists, err := c.secrets.get(namespace + "/" + name)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	secret, ok := obj.(*v1.Secret)
+	return secret, ok, nil
+}
+
+func (c *kubernetesCache) getConfigMap(namespace string, name string) (*v1.ConfigMap, bool, error) {
+	obj, exists, err := c.configMaps.get(namespace + "/" + name)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	configMap, ok := obj.(*v1.ConfigMap)
+	return configMap, ok, nil
+}
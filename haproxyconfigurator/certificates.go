@@ -0,0 +1,145 @@
+package haproxyconfigurator
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"path"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+// managedFilePrefix marks the files in the certificate directory owned by the configurator;
+// other files there are left alone when orphaned files are removed
+const managedFilePrefix = "k8s-"
+
+// certificateFiles maps file names in the certificate directory to their contents
+type certificateFiles map[string][]byte
+
+// equal reports whether both sets hold the same files with the same contents
+func (c certificateFiles) equal(other certificateFiles) bool {
+	if len(c) != len(other) {
+		return false
+	}
+	for name, data := range c {
+		if otherData, exists := other[name]; !exists || !bytes.Equal(data, otherData) {
+			return false
+		}
+	}
+	return true
+}
+
+func isManagedFile(name string) bool {
+	return strings.HasPrefix(name, managedFilePrefix)
+}
+
+// clientCAKey is the key of the CA bundle in client certificate secrets and config maps
+const clientCAKey = "ca.crt"
+
+// certificatePath returns where haproxy finds a file of the certificate directory
+func certificatePath(options GeneratorOptions, name string) string {
+	return path.Join(options.CertificateDir, name)
+}
+
+// provisionedCertificate returns where haproxy finds a certificate file provisioned on the load
+// balancers; managed file names are refused, as those files are removed as orphans
+func provisionedCertificate(options GeneratorOptions, name string) (string, error) {
+	certificate := certificatePath(options, name)
+	if path.Dir(certificate) == path.Clean(options.CertificateDir) && isManagedFile(path.Base(certificate)) {
+		return "", errors.New("Certificate file " + name + " uses the " + managedFilePrefix + " prefix reserved for certificates synced from secrets")
+	}
+	return certificate, nil
+}
+
+// secretCertificate adds the certificate and key of a kubernetes.io/tls secret to files as a
+// single PEM and returns the PEM's file name
+func secretCertificate(cache *kubernetesCache, files certificateFiles, namespace string, name string) (string, error) {
+	secret, exists, err := cache.getSecret(namespace, name)
+	if err != nil {
+		return "", errors.New("Cannot read secret " + namespace + "/" + name + ": " + err.Error())
+	}
+	if !exists {
+		return "", errors.New("Secret " + namespace + "/" + name + " does not exist")
+	}
+	if secret.Type != v1.SecretTypeTLS {
+		return "", errors.New("Secret " + namespace + "/" + name + " is not of type " + string(v1.SecretTypeTLS))
+	}
+	certificate, key := secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey]
+	if _, err := tls.X509KeyPair(certificate, key); err != nil {
+		return "", errors.New("Secret " + namespace + "/" + name + " does not hold a valid certificate and key: " + err.Error())
+	}
+
+	var pem = append([]byte{}, certificate...)
+	if !bytes.HasSuffix(pem, []byte("\n")) {
+		pem = append(pem, '\n')
+	}
+	pem = append(pem, key...)
+	fileName := managedFilePrefix + "secret_" + namespace + "_" + name + ".pem"
+	files[fileName] = pem
+	return fileName, nil
+}
+
+// clientVerification adds the CA bundle named by the client-ca-secret or client-ca-configmap annotation
+// read through anno to files and returns the verification mode and CA file, or empty strings without one
+func clientVerification(cache *kubernetesCache, files certificateFiles, options GeneratorOptions, namespace string, anno func(name string) string) (string, string, error) {
+	secretName, configMapName := anno("client-ca-secret"), anno("client-ca-configmap")
+	if secretName == "" && configMapName == "" {
+		if anno("client-verify") != "" {
+			return "", "", errors.New("client-verify requires client-ca-secret or client-ca-configmap")
+		}
+		return "", "", nil
+	}
+	if secretName != "" && configMapName != "" {
+		return "", "", errors.New("Only one of client-ca-secret (" + secretName + ") and client-ca-configmap (" + configMapName + ") can be specified")
+	}
+	var verify = "required"
+	if value := anno("client-verify"); value != "" {
+		if value != "required" && value != "optional" {
+			return "", "", errors.New("Invalid client-verify (" + value + ") specified - valid options 'required', 'optional'")
+		}
+		verify = value
+	}
+
+	var source, bundle string
+	if secretName != "" {
+		source = "Secret " + namespace + "/" + secretName
+		secret, exists, err := cache.getSecret(namespace, secretName)
+		if err != nil {
+			return "", "", errors.New("Cannot read " + source + ": " + err.Error())
+		}
+		if !exists {
+			return "", "", errors.New(source + " does not exist")
+		}
+		data, exists := secret.Data[clientCAKey]
+		if !exists {
+			return "", "", errors.New(source + " has no " + clientCAKey + " key")
+		}
+		bundle = string(data)
+	} else {
+		source = "ConfigMap " + namespace + "/" + configMapName
+		configMap, exists, err := cache.getConfigMap(namespace, configMapName)
+		if err != nil {
+			return "", "", errors.New("Cannot read " + source + ": " + err.Error())
+		}
+		if !exists {
+			return "", "", errors.New(source + " does not exist")
+		}
+		data, exists := configMap.Data[clientCAKey]
+		if !exists {
+			return "", "", errors.New(source + " has no " + clientCAKey + " key")
+		}
+		bundle = data
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM([]byte(bundle)) {
+		return "", "", errors.New(source + " does not hold PEM CA certificates in " + clientCAKey)
+	}
+
+	var fileName = managedFilePrefix + "secret_" + namespace + "_" + secretName + "_ca.pem"
+	if configMapName != "" {
+		fileName = managedFilePrefix + "configmap_" + namespace + "_" + configMapName + "_ca.pem"
+	}
+	files[fileName] = []byte(bundle)
+	return verify, certificatePath(options, fileName), nil
+}
@@ -0,0 +1,115 @@
+package haproxyconfigurator
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProvisionedCertificate(t *testing.T) {
+	options := GeneratorOptions{CertificateDir: "/etc/haproxy/ssl"}
+	for _, test := range []struct {
+		name     string
+		expected string
+		valid    bool
+	}{
+		{"www.example.com.pem", "/etc/haproxy/ssl/www.example.com.pem", true},
+		{"k8s-secret_default_www.pem", "", false},
+		{"./k8s-api.example.com.pem", "", false},
+		{"k8s-api.example.com.pem", "", false},
+		{"k8s/www.pem", "/etc/haproxy/ssl/k8s/www.pem", true},
+		{"legacy/k8s-www.pem", "/etc/haproxy/ssl/legacy/k8s-www.pem", true},
+	} {
+		certificate, err := provisionedCertificate(options, test.name)
+		if (err == nil) != test.valid || certificate != test.expected {
+			t.Errorf("%s: expected %q (valid %v), got %q (%v)", test.name, test.expected, test.valid, certificate, err)
+		}
+	}
+}
+
+// testCABundle returns a PEM self-signed CA certificate
+func testCABundle(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Client CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestClientVerification(t *testing.T) {
+	bundle := testCABundle(t)
+	cache := newTestCache(t,
+		&v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "clients"}, Data: map[string][]byte{clientCAKey: []byte(bundle)}},
+		&v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tls"}, Data: map[string][]byte{"tls.crt": []byte(bundle)}},
+		&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "clients"}, Data: map[string]string{clientCAKey: bundle}},
+		&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "garbage"}, Data: map[string]string{clientCAKey: "not a certificate"}},
+	)
+	options := GeneratorOptions{CertificateDir: "/etc/haproxy/ssl"}
+	for _, test := range []struct {
+		name        string
+		annotations map[string]string
+		verify      string
+		caFile      string
+		files       certificateFiles
+		invalid     bool
+	}{
+		{"no verification", nil, "", "", certificateFiles{}, false},
+		{"secret", map[string]string{"client-ca-secret": "clients"}, "required", "/etc/haproxy/ssl/k8s-secret_default_clients_ca.pem",
+			certificateFiles{"k8s-secret_default_clients_ca.pem": []byte(bundle)}, false},
+		{"config map", map[string]string{"client-ca-configmap": "clients", "client-verify": "optional"}, "optional", "/etc/haproxy/ssl/k8s-configmap_default_clients_ca.pem",
+			certificateFiles{"k8s-configmap_default_clients_ca.pem": []byte(bundle)}, false},
+		{"verify without CA", map[string]string{"client-verify": "required"}, "", "", nil, true},
+		{"bad verify", map[string]string{"client-ca-secret": "clients", "client-verify": "none"}, "", "", nil, true},
+		{"secret and config map", map[string]string{"client-ca-secret": "clients", "client-ca-configmap": "clients"}, "", "", nil, true},
+		{"missing secret", map[string]string{"client-ca-secret": "missing"}, "", "", nil, true},
+		{"missing config map", map[string]string{"client-ca-configmap": "missing"}, "", "", nil, true},
+		{"secret without CA", map[string]string{"client-ca-secret": "tls"}, "", "", nil, true},
+		{"config map without PEM", map[string]string{"client-ca-configmap": "garbage"}, "", "", nil, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			files := certificateFiles{}
+			verify, caFile, err := clientVerification(cache, files, options, "default", func(name string) string { return test.annotations[name] })
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %q and %q", verify, caFile)
+				}
+				if len(files) > 0 {
+					t.Errorf("expected no files, got %v", files)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if verify != test.verify || caFile != test.caFile {
+				t.Errorf("expected %q and %q, got %q and %q", test.verify, test.caFile, verify, caFile)
+			}
+			if !reflect.DeepEqual(files, test.files) {
+				t.Errorf("expected files %v, got %v", test.files, files)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package haproxyconfigurator
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+// ConsumerConfig describes how a load balancer applies published configurations
+type ConsumerConfig struct {
+	// ConfigPath is where the dynamic configuration is written
+	ConfigPath string
+	// HaproxyBinary is used to check configurations before they are put in place
+	HaproxyBinary string
+	// BaseConfigPath is the main haproxy configuration loaded alongside the dynamic one
+	BaseConfigPath string
+	// ReloadCommand is executed after a new configuration has been written
+	ReloadCommand string
+	// CertificateDir is where certificates published with the configuration are written
+	CertificateDir string
+}
+
+// Consume watches the configured etcd key and applies every valid configuration published to it
+func Consume(etcdConfig EtcdConfig, consumerConfig ConsumerConfig) {
+	if !etcdConfig.Enabled() {
+		logger.Fatal("At least one etcd host is required to consume configurations")
+	}
+	keys, err := etcdKeysAPI(etcdConfig)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	var index uint64
+	for {
+		if index == 0 {
+			index, err = consumeCurrent(keys, etcdConfig.Path, consumerConfig)
+			if err != nil {
+				logger.Error(err)
+				time.Sleep(time.Second)
+				continue
+			}
+		}
+
+		logger.Debugf("Watching %s for changes after index %d", etcdConfig.Path, index)
+		watcher := keys.Watcher(etcdConfig.Path, &client.WatcherOptions{AfterIndex: index})
+		for {
+			resp, err := watcher.Next(context.Background())
+			if err != nil {
+				if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == client.ErrorCodeEventIndexCleared {
+					logger.Info("Watch index cleared; reloading current configuration")
+					index = 0
+					break
+				}
+				logger.Error(err)
+				time.Sleep(time.Second)
+				continue
+			}
+			index = resp.Index
+			if resp.Node == nil || resp.Action == "delete" || resp.Action == "expire" {
+				logger.Warnf("Configuration key %s was removed; keeping the current configuration", etcdConfig.Path)
+				continue
+			}
+			logger.Infof("Detected change to %s (%s)", etcdConfig.Path, resp.Action)
+			certificates, err := getEtcdCertificates(keys, etcdConfig.Path)
+			if err != nil {
+				logger.Error(err)
+				continue
+			}
+			if err := applyConfig(resp.Node.Value, certificates, consumerConfig); err != nil {
+				logger.Error(err)
+			}
+		}
+	}
+}
+
+// consumeCurrent applies the configuration currently stored in etcd and returns the index to watch from
+func consumeCurrent(keys client.KeysAPI, path string, consumerConfig ConsumerConfig) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), client.DefaultRequestTimeout)
+	defer cancel()
+	resp, err := keys.Get(ctx, path, &client.GetOptions{Quorum: true})
+	if err != nil {
+		if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == client.ErrorCodeKeyNotFound {
+			logger.Warnf("Configuration key %s does not exist yet", path)
+			return etcdErr.Index, nil
+		}
+		return 0, err
+	}
+	certificates, err := getEtcdCertificates(keys, path)
+	if err != nil {
+		return 0, err
+	}
+	if err := applyConfig(resp.Node.Value, certificates, consumerConfig); err != nil {
+		logger.Error(err)
+	}
+	return resp.Index, nil
+}
+
+// applyConfig checks a configuration with haproxy against its staged certificates and only then moves
+// both into place, removes orphaned certificates and reloads
+func applyConfig(config string, certificates certificateFiles, consumerConfig ConsumerConfig) error {
+	currentCertificates, err := readManagedFiles(consumerConfig.CertificateDir)
+	if err != nil {
+		return err
+	}
+	if dat, err := ioutil.ReadFile(consumerConfig.ConfigPath); err == nil && string(dat) == config && currentCertificates.equal(certificates) {
+		logger.Debug("No change to config")
+		return nil
+	}
+
+	// The running haproxy may be restarted at any time, so nothing it loads changes before the check passes
+	staging, err := stageManagedFiles(consumerConfig.CertificateDir, certificates)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	tmp, err := writeTempFile(consumerConfig.ConfigPath, []byte(stagedPaths(config, consumerConfig.CertificateDir, staging)), 0644)
+	if err != nil {
+		return err
+	}
+	err = checkConfig(tmp, consumerConfig)
+	os.Remove(tmp)
+	if err != nil {
+		return err
+	}
+
+	// Certificates must be in place before the configuration referencing them
+	if err := writeManagedFiles(consumerConfig.CertificateDir, certificates); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(consumerConfig.ConfigPath, []byte(config), 0644); err != nil {
+		return err
+	}
+	if err := removeOrphanedFiles(consumerConfig.CertificateDir, certificates); err != nil {
+		logger.Warn(err)
+	}
+	logger.Info("HAProxy config check passed; reloading")
+	return runCommand(consumerConfig.ReloadCommand)
+}
+
+func checkConfig(path string, consumerConfig ConsumerConfig) error {
+	args := []string{}
+	if consumerConfig.BaseConfigPath != "" {
+		args = append(args, "-f", consumerConfig.BaseConfigPath)
+	}
+	args = append(args, "-f", path, "-c", "-q")
+	logger.Debugf("Checking config with %s %v", consumerConfig.HaproxyBinary, args)
+	output, err := exec.Command(consumerConfig.HaproxyBinary, args...).CombinedOutput()
+	if err != nil {
+		logger.Error(string(output))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package haproxyconfigurator
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+// EtcdConfig describes the etcd cluster used to store generated configurations
+type EtcdConfig struct {
+	Hosts          []string
+	Path           string
+	CaFile         string
+	ClientCertFile string
+	ClientKeyFile  string
+}
+
+// Enabled reports whether an etcd cluster has been configured
+func (e EtcdConfig) Enabled() bool {
+	return len(e.Hosts) > 0
+}
+
+func (e EtcdConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if e.CaFile != "" {
+		ca, err := ioutil.ReadFile(e.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("No certificates could be loaded from " + e.CaFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if e.ClientCertFile != "" || e.ClientKeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(e.ClientCertFile, e.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+func etcdKeysAPI(config EtcdConfig) (client.KeysAPI, error) {
+	if config.Path == "" {
+		return nil, errors.New("An etcd path must be provided")
+	}
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.New(client.Config{
+		Endpoints: config.Hosts,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).Dial,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     tlsConfig,
+		},
+		HeaderTimeoutPerRequest: client.DefaultRequestTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return client.NewKeysAPI(c), nil
+}
+
+// etcdPublisher stores the generated configuration in a single etcd key and each certificate
+// in a key of the certificates directory next to it
+type etcdPublisher struct {
+	keys client.KeysAPI
+	path string
+}
+
+func newEtcdPublisher(config EtcdConfig) (*etcdPublisher, error) {
+	keys, err := etcdKeysAPI(config)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdPublisher{keys: keys, path: config.Path}, nil
+}
+
+// etcdCertificatesPath is the etcd directory holding the certificates published with the configuration at path
+func etcdCertificatesPath(path string) string {
+	return path + "-certificates"
+}
+
+// getEtcdCertificates reads the certificates published with the configuration at path
+func getEtcdCertificates(keys client.KeysAPI, path string) (certificateFiles, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), client.DefaultRequestTimeout)
+	defer cancel()
+	var certificates = certificateFiles{}
+	resp, err := keys.Get(ctx, etcdCertificatesPath(path), &client.GetOptions{Quorum: true, Recursive: true})
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return certificates, nil
+		}
+		return nil, err
+	}
+	for _, node := range resp.Node.Nodes {
+		if !node.Dir {
+			certificates[strings.TrimPrefix(node.Key, etcdCertificatesPath(path)+"/")] = []byte(node.Value)
+		}
+	}
+	return certificates, nil
+}
+
+func (e *etcdPublisher) current() (generatedConfig, error) {
+	certificates, err := getEtcdCertificates(e.keys, e.path)
+	if err != nil {
+		return generatedConfig{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), client.DefaultRequestTimeout)
+	defer cancel()
+	resp, err := e.keys.Get(ctx, e.path, &client.GetOptions{Quorum: true})
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return generatedConfig{certificates: certificates}, nil
+		}
+		return generatedConfig{}, err
+	}
+	return generatedConfig{config: resp.Node.Value, certificates: certificates}, nil
+}
+
+func (e *etcdPublisher) publish(generated generatedConfig) error {
+	current, err := getEtcdCertificates(e.keys, e.path)
+	if err != nil {
+		return err
+	}
+
+	// Consumers only watch the configuration key, so certificates are published first
+	for name, data := range generated.certificates {
+		if currentData, exists := current[name]; exists && string(currentData) == string(data) {
+			continue
+		}
+		logger.Infof("Publishing certificate %s to etcd", name)
+		if err := e.set(etcdCertificatesPath(e.path)+"/"+name, string(data)); err != nil {
+			return err
+		}
+	}
+	logger.Infof("Publishing config to etcd key %s", e.path)
+	if err := e.set(e.path, generated.config); err != nil {
+		return err
+	}
+	for name := range current {
+		if _, exists := generated.certificates[name]; exists {
+			continue
+		}
+		logger.Infof("Removing orphaned certificate %s from etcd", name)
+		ctx, cancel := context.WithTimeout(context.Background(), client.DefaultRequestTimeout)
+		_, err := e.keys.Delete(ctx, etcdCertificatesPath(e.path)+"/"+name, nil)
+		cancel()
+		if err != nil && !client.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *etcdPublisher) set(key string, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), client.DefaultRequestTimeout)
+	defer cancel()
+	_, err := e.keys.Set(ctx, key, value, nil)
+	return err
+}
@@ -0,0 +1,182 @@
+package haproxyconfigurator
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// writeTempFile writes data to a temporary file next to path so it can later be renamed into place
+func writeTempFile(path string, data []byte, perm os.FileMode) (string, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// writeFileAtomic replaces the file at path without readers ever seeing a partial write
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := writeTempFile(path, data, perm)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// readManagedFiles reads the files of the directory owned by the configurator
+func readManagedFiles(dir string) (certificateFiles, error) {
+	var files = certificateFiles{}
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isManagedFile(entry.Name()) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files[entry.Name()] = data
+	}
+	return files, nil
+}
+
+// writeManagedFiles atomically writes the files that differ from the ones in the directory,
+// readable by the owner only since they hold private keys
+func writeManagedFiles(dir string, files certificateFiles) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if current, err := ioutil.ReadFile(path); err == nil && bytes.Equal(current, data) {
+			continue
+		}
+		logger.Infof("Writing %s", path)
+		if err := writeFileAtomic(path, data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeOrphanedFiles deletes the files of the directory owned by the configurator that are not in files
+func removeOrphanedFiles(dir string, files certificateFiles) error {
+	current, err := readManagedFiles(dir)
+	if err != nil {
+		return err
+	}
+	for name := range current {
+		if _, exists := files[name]; exists {
+			continue
+		}
+		logger.Infof("Removing orphaned %s", filepath.Join(dir, name))
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// stageManagedFiles writes files to a new directory next to dir, so haproxy can check a configuration
+// against them before they replace the files of dir.  The other files of dir are linked into it, so
+// certificates provisioned by hand are found there as well.
+func stageManagedFiles(dir string, files certificateFiles) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	staging, err := ioutil.TempDir(filepath.Dir(filepath.Clean(dir)), "."+filepath.Base(dir)+".")
+	if err != nil {
+		return "", err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+	for _, entry := range entries {
+		if isManagedFile(entry.Name()) {
+			continue
+		}
+		if err := os.Symlink(filepath.Join(dir, entry.Name()), filepath.Join(staging, entry.Name())); err != nil {
+			os.RemoveAll(staging)
+			return "", err
+		}
+	}
+	for name, data := range files {
+		// crt-lists name the certificates they load by path, which must be the staged ones
+		if strings.HasSuffix(name, crtListExtension) {
+			data = []byte(stagedCrtList(string(data), dir, staging))
+		}
+		if err := ioutil.WriteFile(filepath.Join(staging, name), data, 0600); err != nil {
+			os.RemoveAll(staging)
+			return "", err
+		}
+	}
+	return staging, nil
+}
+
+// pathArgumentPattern matches the keywords whose argument is a file haproxy loads from the certificate
+// directory, along with that argument
+var pathArgumentPattern = regexp.MustCompile(`(^|\s)(crt|crt-list|ca-file)(\s+)(\S+)`)
+
+// crtListCertificatePattern matches the certificate starting each line of a crt-list
+var crtListCertificatePattern = regexp.MustCompile(`(?m)^(\s*)(\S+)`)
+
+// stagedPath points path at the staging directory if it is a file of dir
+func stagedPath(path string, dir string, staging string) string {
+	if prefix := filepath.Clean(dir) + "/"; strings.HasPrefix(path, prefix) {
+		return staging + "/" + strings.TrimPrefix(path, prefix)
+	}
+	return path
+}
+
+// stagedPaths points the crt, crt-list and ca-file arguments into dir of a configuration at the
+// staging directory instead
+func stagedPaths(config string, dir string, staging string) string {
+	return pathArgumentPattern.ReplaceAllStringFunc(config, func(argument string) string {
+		match := pathArgumentPattern.FindStringSubmatch(argument)
+		return match[1] + match[2] + match[3] + stagedPath(match[4], dir, staging)
+	})
+}
+
+// stagedCrtList points the certificates and ca-file options into dir of a crt-list at the staging
+// directory instead
+func stagedCrtList(crtList string, dir string, staging string) string {
+	crtList = crtListCertificatePattern.ReplaceAllStringFunc(crtList, func(line string) string {
+		match := crtListCertificatePattern.FindStringSubmatch(line)
+		return match[1] + stagedPath(match[2], dir, staging)
+	})
+	return stagedPaths(crtList, dir, staging)
+}
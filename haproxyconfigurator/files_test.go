@@ -0,0 +1,221 @@
+package haproxyconfigurator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStagedPaths(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{"crt-list", "  bind *:443 ssl crt-list /etc/haproxy/ssl/k8s-listener.crt-list\n",
+			"  bind *:443 ssl crt-list /staging/k8s-listener.crt-list\n"},
+		{"crt and ca-file", "  bind *:443 ssl crt /etc/haproxy/ssl/www.pem ca-file /etc/haproxy/ssl/ca.pem verify required\n",
+			"  bind *:443 ssl crt /staging/www.pem ca-file /staging/ca.pem verify required\n"},
+		{"trailing slash", "  bind *:443 ssl crt /etc/haproxy/ssl/www.pem\n", "  bind *:443 ssl crt /staging/www.pem\n"},
+		{"other directories", "  bind *:443 ssl crt /etc/haproxy/ssl2/www.pem ca-file /etc/ssl/ca.pem\n",
+			"  bind *:443 ssl crt /etc/haproxy/ssl2/www.pem ca-file /etc/ssl/ca.pem\n"},
+		{"other arguments", "  http-request set-header X-Path /etc/haproxy/ssl/www.pem\n  errorfile 503 /etc/haproxy/ssl/503.http\n",
+			"  http-request set-header X-Path /etc/haproxy/ssl/www.pem\n  errorfile 503 /etc/haproxy/ssl/503.http\n"},
+	} {
+		dir := "/etc/haproxy/ssl"
+		if test.name == "trailing slash" {
+			dir += "/"
+		}
+		if staged := stagedPaths(test.config, dir, "/staging"); staged != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, staged)
+		}
+	}
+}
+
+func TestStagedCrtList(t *testing.T) {
+	crtList := "/etc/haproxy/ssl/k8s-secret_default_www.pem !*\n" +
+		"/etc/haproxy/ssl/k8s-secret_default_www.pem [alpn h2 verify required ca-file /etc/haproxy/ssl/k8s-configmap_default_ca_ca.pem] www.example.com\n" +
+		"/etc/haproxy/ssl/shop.example.com.pem shop.example.com\n" +
+		"/etc/ssl/admin.pem [ca-file /etc/ssl/ca.pem] admin.example.com\n"
+	expected := "/staging/k8s-secret_default_www.pem !*\n" +
+		"/staging/k8s-secret_default_www.pem [alpn h2 verify required ca-file /staging/k8s-configmap_default_ca_ca.pem] www.example.com\n" +
+		"/staging/shop.example.com.pem shop.example.com\n" +
+		"/etc/ssl/admin.pem [ca-file /etc/ssl/ca.pem] admin.example.com\n"
+	if staged := stagedCrtList(crtList, "/etc/haproxy/ssl", "/staging"); staged != expected {
+		t.Errorf("expected %q, got %q", expected, staged)
+	}
+}
+
+// writeTestFiles creates dir holding files
+func writeTestFiles(t *testing.T, dir string, files certificateFiles) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// expectTestFiles checks dir holds exactly the files expected
+func expectTestFiles(t *testing.T, dir string, expected certificateFiles) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files = certificateFiles{}
+	for _, entry := range entries {
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = data
+	}
+	if !files.equal(expected) {
+		t.Errorf("expected %s to hold %q, got %q", dir, expected, files)
+	}
+}
+
+func TestStageManagedFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ssl")
+	writeTestFiles(t, dir, certificateFiles{
+		"shop.example.com.pem":       []byte("hand-provisioned"),
+		"k8s-secret_default_old.pem": []byte("orphaned"),
+		"k8s-secret_default_www.pem": []byte("previous"),
+	})
+	files := certificateFiles{
+		"k8s-secret_default_www.pem": []byte("rotated"),
+		"k8s-listener.crt-list": []byte(dir + "/k8s-secret_default_www.pem www.example.com\n" +
+			dir + "/shop.example.com.pem shop.example.com\n"),
+	}
+
+	staging, err := stageManagedFiles(dir, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(staging)
+	if filepath.Dir(staging) != filepath.Dir(dir) {
+		t.Errorf("expected %s to be staged next to it, got %s", dir, staging)
+	}
+	expectTestFiles(t, staging, certificateFiles{
+		"shop.example.com.pem":       []byte("hand-provisioned"),
+		"k8s-secret_default_www.pem": []byte("rotated"),
+		"k8s-listener.crt-list": []byte(staging + "/k8s-secret_default_www.pem www.example.com\n" +
+			staging + "/shop.example.com.pem shop.example.com\n"),
+	})
+	if target, err := os.Readlink(filepath.Join(staging, "shop.example.com.pem")); err != nil || target != filepath.Join(dir, "shop.example.com.pem") {
+		t.Errorf("expected the hand-provisioned certificate to be linked, got %q (%v)", target, err)
+	}
+	// Staging leaves the directory in use alone
+	expectTestFiles(t, dir, certificateFiles{
+		"shop.example.com.pem":       []byte("hand-provisioned"),
+		"k8s-secret_default_old.pem": []byte("orphaned"),
+		"k8s-secret_default_www.pem": []byte("previous"),
+	})
+}
+
+func TestRemoveOrphanedFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, certificateFiles{
+		"shop.example.com.pem":       []byte("hand-provisioned"),
+		"k8s-secret_default_old.pem": []byte("orphaned"),
+		"k8s-secret_default_www.pem": []byte("current"),
+	})
+	if err := removeOrphanedFiles(dir, certificateFiles{"k8s-secret_default_www.pem": []byte("current")}); err != nil {
+		t.Fatal(err)
+	}
+	expectTestFiles(t, dir, certificateFiles{
+		"shop.example.com.pem":       []byte("hand-provisioned"),
+		"k8s-secret_default_www.pem": []byte("current"),
+	})
+
+	if err := removeOrphanedFiles(filepath.Join(dir, "missing"), certificateFiles{}); err != nil {
+		t.Errorf("expected a missing directory to have no orphans, got %v", err)
+	}
+}
+
+// fakeHaproxy stands in for the haproxy binary: the check fails if the configuration says so, or if
+// a crt-list or certificate it loads is missing
+const fakeHaproxy = `#!/bin/sh
+grep -q invalid "$2" && exit 1
+for list in $(sed -n 's/.*crt-list \([^ ]*\).*/\1/p' "$2"); do
+	[ -f "$list" ] || exit 1
+	for certificate in $(cut -d ' ' -f 1 "$list"); do
+		[ -f "$certificate" ] || exit 1
+	done
+done
+exit 0
+`
+
+func TestApplyConfig(t *testing.T) {
+	root := t.TempDir()
+	binary := filepath.Join(root, "haproxy")
+	if err := ioutil.WriteFile(binary, []byte(fakeHaproxy), 0755); err != nil {
+		t.Fatal(err)
+	}
+	consumerConfig := ConsumerConfig{
+		ConfigPath:     filepath.Join(root, "haproxy.cfg"),
+		HaproxyBinary:  binary,
+		ReloadCommand:  "touch " + filepath.Join(root, "reloaded"),
+		CertificateDir: filepath.Join(root, "ssl"),
+	}
+	dir := consumerConfig.CertificateDir
+	writeTestFiles(t, dir, certificateFiles{
+		"shop.example.com.pem":       []byte("hand-provisioned"),
+		"k8s-secret_default_old.pem": []byte("orphaned"),
+	})
+	certificates := certificateFiles{
+		"k8s-secret_default_www.pem": []byte("synced"),
+		"k8s-listener.crt-list": []byte(dir + "/k8s-secret_default_www.pem www.example.com\n" +
+			dir + "/shop.example.com.pem shop.example.com\n"),
+	}
+	config := "frontend k8s-listener\n  bind *:443 ssl crt-list " + dir + "/k8s-listener.crt-list\n"
+
+	reloaded := func() bool {
+		_, err := os.Stat(filepath.Join(root, "reloaded"))
+		return err == nil
+	}
+	expectUnchanged := func() {
+		if _, err := os.Stat(consumerConfig.ConfigPath); !os.IsNotExist(err) {
+			t.Errorf("expected no configuration to be written, got %v", err)
+		}
+		expectTestFiles(t, dir, certificateFiles{
+			"shop.example.com.pem":       []byte("hand-provisioned"),
+			"k8s-secret_default_old.pem": []byte("orphaned"),
+		})
+		if reloaded() {
+			t.Error("expected no reload")
+		}
+	}
+
+	if err := applyConfig("invalid\n"+config, certificates, consumerConfig); err == nil {
+		t.Error("expected an invalid configuration to fail the check")
+	}
+	expectUnchanged()
+
+	missing := certificateFiles{"k8s-listener.crt-list": []byte(dir + "/k8s-secret_default_missing.pem www.example.com\n")}
+	if err := applyConfig(config, missing, consumerConfig); err == nil {
+		t.Error("expected a crt-list loading a missing certificate to fail the check")
+	}
+	expectUnchanged()
+
+	if err := applyConfig(config, certificates, consumerConfig); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(consumerConfig.ConfigPath); err != nil || string(data) != config {
+		t.Errorf("expected the configuration %q to be written, got %q (%v)", config, data, err)
+	}
+	expectTestFiles(t, dir, certificateFiles{
+		"shop.example.com.pem":       []byte("hand-provisioned"),
+		"k8s-secret_default_www.pem": []byte("synced"),
+		"k8s-listener.crt-list":      certificates["k8s-listener.crt-list"],
+	})
+	if !reloaded() {
+		t.Error("expected a reload")
+	}
+	if entries, err := ioutil.ReadDir(root); err != nil || len(entries) != 4 {
+		t.Errorf("expected the staging directory to be removed, got %v (%v)", entries, err)
+	}
+}
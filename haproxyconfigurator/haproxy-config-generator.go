@@ -1,38 +1,72 @@
 package haproxyconfigurator
 
 import (
+	"net"
+	"path"
+	"regexp"
 	"sort"
 	"strconv"
-
-	"github.com/fatih/color"
+	"strings"
 )
 
 // HaproxyConfigurator provides an interface to dynamically generate haproxy configs
 type HaproxyConfigurator struct {
 	desiredConfig haproxyConfig
+	// Version selects the directive dialect of the rendered configuration
+	Version HaproxyVersion
+	// CertificateDir is where haproxy finds the crt-list files of TLS listeners
+	CertificateDir string
+	// SSLDefaults is the TLS policy of every TLS bind; the SslOptions of a hostname override it
+	SSLDefaults HaproxySSLOptions
 }
 
 // Initialize sets up a new HaproxyConfigurator
 func (h *HaproxyConfigurator) Initialize() {
 	h.desiredConfig.listenIPs = make(map[string]map[uint16]*haproxyListener)
+	h.desiredConfig.userlists = make(map[string]*HaproxyUserlist)
+	h.Version = oldestHaproxyVersion
+	h.CertificateDir = "/etc/haproxy/ssl"
 }
 
 // HaproxyListenerConfig structure provides configuration options
 type HaproxyListenerConfig struct {
-	Name             string
-	Backend          HaproxyBackend
-	Hostname         string
-	ListenIP         string
-	ListenPort       uint16
-	Mode             string
-	SslCertificate   string
-	validationErrors []string
+	Name           string
+	Backend        HaproxyBackend
+	Hostname       string
+	PathPrefix     string
+	PathRegex      string
+	ListenIP       string
+	ListenPort     uint16
+	Mode           string
+	SslCertificate string
+	// SslOptions are the TLS settings for the hostname's certificate
+	SslOptions HaproxySSLOptions
+	// AllowCIDRs and DenyCIDRs restrict the client IPs of the hostname, or of the whole listener in 'tcp' mode
+	AllowCIDRs []string
+	DenyCIDRs  []string
+	// BasicAuth requires requests for the hostname to authenticate; nil for none
+	BasicAuth *HaproxyBasicAuth
+	// ClientDNHeader is the request header passing the subject of the verified client certificate to
+	// the backend; empty for none
+	ClientDNHeader string
+	// SNIPassthrough routes the hostname's TLS connections by SNI without terminating them, sharing a
+	// 'tcp' mode listener with other passthrough hostnames
+	SNIPassthrough bool
+	// RedirectHTTPListener names the plain HTTP listener on port 80 of the same IP that redirects
+	// the hostname to this listener; empty for no redirect
+	RedirectHTTPListener string
+	validationErrors     []string
 }
 
 func (hlc *HaproxyListenerConfig) addValidationError(message string) {
 	hlc.validationErrors = append(hlc.validationErrors, message)
 }
 
+// route identifies the requests the listener config claims
+func (hlc *HaproxyListenerConfig) route() haproxyRoute {
+	return haproxyRoute{hostname: hlc.Hostname, pathPrefix: hlc.PathPrefix, pathRegex: hlc.PathRegex}
+}
+
 func (hlc *HaproxyListenerConfig) validate(h *HaproxyConfigurator) bool {
 	// Default to validated
 	var validated = true
@@ -43,6 +77,127 @@ func (hlc *HaproxyListenerConfig) validate(h *HaproxyConfigurator) bool {
 		validated = false
 	}
 
+	// Check path routing
+	if hlc.PathPrefix != "" || hlc.PathRegex != "" {
+		if hlc.Mode == "tcp" {
+			hlc.addValidationError("Path routing is only available in 'http' mode")
+			validated = false
+		}
+		if hlc.PathPrefix != "" && hlc.PathRegex != "" {
+			hlc.addValidationError("Only one of path prefix (" + hlc.PathPrefix + ") and path regex (" + hlc.PathRegex + ") can be specified")
+			validated = false
+		}
+		if hlc.PathPrefix != "" && !strings.HasPrefix(hlc.PathPrefix, "/") {
+			hlc.addValidationError("Invalid path prefix (" + hlc.PathPrefix + ") specified - it must start with '/'")
+			validated = false
+		}
+		if strings.ContainsAny(hlc.PathPrefix+hlc.PathRegex, " \t") {
+			hlc.addValidationError("Path prefixes and regexes cannot contain whitespace")
+			validated = false
+		}
+		if _, err := regexp.Compile(hlc.PathRegex); err != nil {
+			hlc.addValidationError("Invalid path regex (" + hlc.PathRegex + "): " + err.Error())
+			validated = false
+		}
+	}
+
+	// Check TLS options
+	if hlc.SslOptions != (HaproxySSLOptions{}) && hlc.SslCertificate == "" {
+		hlc.addValidationError("TLS options provided on a service that isn't using SSL")
+		validated = false
+	}
+	if hlc.SslOptions != (HaproxySSLOptions{}) && hlc.SslCertificate != "" && hlc.Hostname == "" {
+		hlc.addValidationError("TLS options require a hostname - clients without SNI always get the --ssl-* defaults")
+		validated = false
+	}
+	for _, message := range hlc.SslOptions.validate(h.Version) {
+		hlc.addValidationError(message)
+		validated = false
+	}
+	if hlc.SslOptions.MinVersion != "" && hlc.SslOptions.MinVersion != h.SSLDefaults.MinVersion && !h.Version.supports(featureCrtListSSLVersion) {
+		hlc.addValidationError("ssl-min-ver (" + hlc.SslOptions.MinVersion + ") can only differ from --ssl-min-ver with haproxy 1.9 or newer (targeting " + h.Version.String() + ")")
+		validated = false
+	}
+
+	// Check access lists
+	for _, cidr := range append(append([]string{}, hlc.AllowCIDRs...), hlc.DenyCIDRs...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+			hlc.addValidationError("Invalid CIDR (" + cidr + ") specified - expected an address like '10.0.0.0/8' or '192.0.2.1'")
+			validated = false
+		}
+	}
+
+	// Check basic authentication
+	if hlc.BasicAuth != nil && hlc.Mode != "http" {
+		hlc.addValidationError("Basic authentication is only available in 'http' mode")
+		validated = false
+	}
+
+	// Check SNI passthrough
+	if hlc.SNIPassthrough && (hlc.Mode != "tcp" || hlc.SslCertificate != "" || hlc.Hostname == "") {
+		hlc.addValidationError("SSL passthrough is only available in 'tcp' mode with a hostname and without SSL")
+		validated = false
+	}
+
+	// Check client certificate verification; requests are only accepted for the SNI they were verified
+	// through, so the hostname is needed to compare them
+	if hlc.SslOptions.CAFile != "" && (hlc.Mode != "http" || hlc.Hostname == "") {
+		hlc.addValidationError("Client certificate verification is only available in 'http' mode with a hostname")
+		validated = false
+	}
+	if hlc.ClientDNHeader != "" {
+		if hlc.SslOptions.CAFile == "" {
+			hlc.addValidationError("Client certificate subject header (" + hlc.ClientDNHeader + ") requires client certificate verification")
+			validated = false
+		}
+		if !headerNamePattern.MatchString(hlc.ClientDNHeader) {
+			hlc.addValidationError("Invalid client certificate subject header (" + hlc.ClientDNHeader + ") specified - only letters, digits and '-' are allowed")
+			validated = false
+		}
+	}
+
+	// Check stickiness
+	if hlc.Backend.Stickiness.Mode == sessionAffinityCookie && hlc.Mode != "http" {
+		hlc.addValidationError("Cookie session affinity is only available in 'http' mode")
+		validated = false
+	}
+
+	// Check HTTPS redirect and HSTS
+	if hlc.RedirectHTTPListener != "" || hlc.Backend.HSTSMaxAge > 0 {
+		if hlc.Mode != "http" || hlc.SslCertificate == "" {
+			hlc.addValidationError("HTTPS redirects and HSTS are only available for 'http' mode services using SSL")
+			validated = false
+		}
+	}
+	if hlc.RedirectHTTPListener != "" {
+		// Redirects are selected by the Host header, so there is nothing to match without a hostname
+		if hlc.Hostname == "" {
+			hlc.addValidationError("HTTPS redirects require a hostname")
+			validated = false
+		}
+		if hlc.ListenPort == httpRedirectPort {
+			hlc.addValidationError("Cannot redirect HTTP to HTTPS on the same port (" + strconv.Itoa(int(hlc.ListenPort)) + ")")
+			validated = false
+		}
+		if redirectListener, exists := h.desiredConfig.listenIPs[hlc.ListenIP][httpRedirectPort]; exists {
+			if redirectListener.mode != "http" || redirectListener.useSSL {
+				hlc.addValidationError("Port " + strconv.Itoa(httpRedirectPort) + " is not a plain HTTP listener and cannot redirect to HTTPS")
+				validated = false
+			}
+			for route, backend := range redirectListener.routeBackends {
+				if route.hostname == hlc.Hostname {
+					hlc.addValidationError("Hostname " + hlc.Hostname + " is already routed to " + backend.Name + " on port " + strconv.Itoa(httpRedirectPort))
+					validated = false
+					break
+				}
+			}
+			if port, exists := redirectListener.redirects[hlc.Hostname]; exists && port != hlc.ListenPort {
+				hlc.addValidationError("Hostname " + hlc.Hostname + " is already redirected to HTTPS on port " + strconv.Itoa(int(port)))
+				validated = false
+			}
+		}
+	}
+
 	// Against other services' configurations
 	if _, exists := h.desiredConfig.listenIPs[hlc.ListenIP]; exists {
 		if _, exists := h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort]; exists {
@@ -57,148 +212,580 @@ func (hlc *HaproxyListenerConfig) validate(h *HaproxyConfigurator) bool {
 				hlc.addValidationError("SSL Certificate provided on a service that isn't using SSL")
 				validated = false
 			}
+
+			// Validate the hostname is served with one certificate; crt-list entries are selected by SNI only
+			if certificate, exists := h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort].certificates[hlc.Hostname]; exists && hlc.SslCertificate != "" {
+				if certificate.Path != hlc.SslCertificate {
+					hlc.addValidationError("Hostname " + hlc.Hostname + " is already served with certificate " + certificate.Path)
+					validated = false
+				}
+				if certificate.Options.withDefaults(h.SSLDefaults) != hlc.SslOptions.withDefaults(h.SSLDefaults) {
+					hlc.addValidationError("Hostname " + hlc.Hostname + " is already served with different TLS options")
+					validated = false
+				}
+			}
+
+			// Validate the hostname passes the client certificate subject in one header
+			if header, exists := h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort].clientDNHeaders[hlc.Hostname]; exists && header != hlc.ClientDNHeader {
+				hlc.addValidationError("Hostname " + hlc.Hostname + " already passes the client certificate subject in header " + header)
+				validated = false
+			}
+
+			// Validate hostnames sharing a certificate share its TLS options; HTTP/2 clients reuse one
+			// connection for every hostname the certificate is valid for, whatever SNI it was opened with
+			for hostname, certificate := range h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort].certificates {
+				if hostname != hlc.Hostname && certificate.Path == hlc.SslCertificate && certificate.Options.withDefaults(h.SSLDefaults) != hlc.SslOptions.withDefaults(h.SSLDefaults) {
+					hlc.addValidationError("Certificate " + certificate.Path + " is already served for hostname " + hostname + " with different TLS options")
+					validated = false
+				}
+			}
+
+			// Validate TCP services only share a port when every one of them is routed by SNI
+			if hlc.Mode == "tcp" && h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort].mode == "tcp" && (!hlc.SNIPassthrough || !h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort].sniPassthrough) {
+				hlc.addValidationError("A listener for another TCP service is already configured on the port (" + strconv.Itoa(int(hlc.ListenPort)) + ") - TCP services can only share a port using SSL passthrough")
+				validated = false
+			}
+
+			// Validate the hostname and path aren't claimed by another backend
+			if backend, exists := h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort].routeBackends[hlc.route()]; exists && backend.Name != hlc.Backend.Name {
+				hlc.addValidationError("Hostname " + hlc.Hostname + hlc.PathPrefix + hlc.PathRegex + " is already routed to " + backend.Name)
+				validated = false
+			}
+			if hlc.Mode == "http" {
+				if _, exists := h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort].redirects[hlc.Hostname]; exists {
+					hlc.addValidationError("Hostname " + hlc.Hostname + " is already redirected to HTTPS from port " + strconv.Itoa(int(hlc.ListenPort)))
+					validated = false
+				}
+			}
 		}
 	}
 
 	return validated
 }
 
-// AddListener to haproxy
+// httpRedirectPort is the plain HTTP port redirected to HTTPS
+const httpRedirectPort = 80
+
+// sniInspectDelay is how long SSL passthrough listeners wait for the TLS client hello
+const sniInspectDelay = "5s"
+
+func newHaproxyListener(name string, mode string, useSSL bool) *haproxyListener {
+	return &haproxyListener{
+		name:            name,
+		mode:            mode,
+		certificates:    make(map[string]HaproxyCertificate),
+		routeBackends:   make(map[haproxyRoute]*HaproxyBackend),
+		useSSL:          useSSL,
+		redirects:       make(map[string]uint16),
+		accessLists:     make(map[haproxyRoute]haproxyAccessList),
+		basicAuth:       make(map[haproxyRoute]*HaproxyBasicAuth),
+		clientDNHeaders: make(map[string]string),
+	}
+}
+
+// AddListener to haproxy, returning whether the listener passed validation
 func (h *HaproxyConfigurator) AddListener(
 	hlc HaproxyListenerConfig,
-) {
+) bool {
 	if hlc.validate(h) {
 		if _, exists := h.desiredConfig.listenIPs[hlc.ListenIP]; !exists {
 			h.desiredConfig.listenIPs[hlc.ListenIP] = make(map[uint16]*haproxyListener)
 		}
 
 		if _, exists := h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort]; !exists {
-			var listener = haproxyListener{
-				name:             hlc.Name,
-				mode:             hlc.Mode,
-				sslCertificates:  []string{},
-				hostnameBackends: make(map[string]*HaproxyBackend),
-				useSSL:           hlc.SslCertificate != "",
-			}
-			h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort] = &listener
-		} else {
-			// Don't allow duplicate listeners on TCP endpoints
-			if hlc.Mode == "tcp" {
-				color.Red("A listener for another TCP service is already configured on the port (" + strconv.Itoa(int(hlc.ListenPort)) + ")")
-				panic("This could cause unpredictability in the service router")
-			}
+			h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort] = newHaproxyListener(hlc.Name, hlc.Mode, hlc.SslCertificate != "")
+			h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort].sniPassthrough = hlc.SNIPassthrough
 		}
 
 		if hlc.SslCertificate != "" {
-			h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort].sslCertificates = append(h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort].sslCertificates, hlc.SslCertificate)
+			h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort].certificates[hlc.Hostname] = HaproxyCertificate{Path: hlc.SslCertificate, Options: hlc.SslOptions}
 		}
 
-		if hlc.Mode == "tcp" {
+		if hlc.Mode == "tcp" && !hlc.SNIPassthrough {
 			hlc.Hostname = "_"
 		}
-		h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort].hostnameBackends[hlc.Hostname] = &hlc.Backend
-	} else {
-		color.Red(hlc.Name)
-		for _, message := range hlc.validationErrors {
-			color.Red("  " + message)
+		h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort].routeBackends[hlc.route()] = &hlc.Backend
+		if len(hlc.AllowCIDRs) > 0 || len(hlc.DenyCIDRs) > 0 {
+			h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort].accessLists[hlc.route()] = haproxyAccessList{allow: hlc.AllowCIDRs, deny: hlc.DenyCIDRs}
+		}
+		if hlc.BasicAuth != nil {
+			h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort].basicAuth[hlc.route()] = hlc.BasicAuth
+			h.desiredConfig.userlists[hlc.BasicAuth.Userlist.Name] = hlc.BasicAuth.Userlist
+		}
+
+		if hlc.ClientDNHeader != "" {
+			h.desiredConfig.listenIPs[hlc.ListenIP][hlc.ListenPort].clientDNHeaders[hlc.Hostname] = hlc.ClientDNHeader
+		}
+
+		if hlc.RedirectHTTPListener != "" {
+			if _, exists := h.desiredConfig.listenIPs[hlc.ListenIP][httpRedirectPort]; !exists {
+				h.desiredConfig.listenIPs[hlc.ListenIP][httpRedirectPort] = newHaproxyListener(hlc.RedirectHTTPListener, "http", false)
+			}
+			h.desiredConfig.listenIPs[hlc.ListenIP][httpRedirectPort].redirects[hlc.Hostname] = hlc.ListenPort
 		}
+		return true
 	}
+	reportInvalidService(hlc.Name, hlc.validationErrors)
+	return false
 }
 
-// Render the haproxy configuration
-func (h *HaproxyConfigurator) Render() string {
-	var config = ""
-	// Sort listenIPS for determinism
+// sortedListenIPs returns the listen IPs in order for determinism
+func (h *HaproxyConfigurator) sortedListenIPs() []string {
 	ips := make([]string, 0, len(h.desiredConfig.listenIPs))
 	for listenIP := range h.desiredConfig.listenIPs {
 		ips = append(ips, listenIP)
-		sort.Strings(ips)
 	}
-	sortListenerMap := func(inner map[uint16]*haproxyListener) []uint16 {
-		ports := make([]uint16, 0, len(inner))
-		for port := range inner {
-			ports = append(ports, port)
+	sort.Strings(ips)
+	return ips
+}
+
+// uniqueSorted returns the sorted values without duplicates
+func uniqueSorted(values []string) []string {
+	sorted := make([]string, len(values))
+	copy(sorted, values)
+	sort.Strings(sorted)
+	unique := []string{}
+	for _, value := range sorted {
+		if len(unique) == 0 || unique[len(unique)-1] != value {
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+func sortListenerMap(inner map[uint16]*haproxyListener) []uint16 {
+	ports := make([]uint16, 0, len(inner))
+	for port := range inner {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i int, j int) bool { return ports[i] < ports[j] })
+	return ports
+}
+
+// sortBackendMap sorts routes by hostname; within a hostname path regexes come first, then the
+// longest path prefixes so they match before shorter ones, then the route without a path
+func sortBackendMap(inner map[haproxyRoute]*HaproxyBackend) []haproxyRoute {
+	routes := make([]haproxyRoute, 0, len(inner))
+	for route := range inner {
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i int, j int) bool {
+		if routes[i].hostname != routes[j].hostname {
+			return routes[i].hostname < routes[j].hostname
+		}
+		if (routes[i].pathRegex != "") != (routes[j].pathRegex != "") {
+			return routes[i].pathRegex != ""
+		}
+		if routes[i].pathRegex != routes[j].pathRegex {
+			return routes[i].pathRegex < routes[j].pathRegex
+		}
+		if len(routes[i].pathPrefix) != len(routes[j].pathPrefix) {
+			return len(routes[i].pathPrefix) > len(routes[j].pathPrefix)
+		}
+		return routes[i].pathPrefix < routes[j].pathPrefix
+	})
+	return routes
+}
+
+// headerNamePattern matches the request header names the configuration sets
+var headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// sortedCertificateHostnames returns the hostnames of a listener's certificates; the entry without
+// SNI filter comes first so it is the default certificate
+func sortedCertificateHostnames(certificates map[string]HaproxyCertificate) []string {
+	hostnames := make([]string, 0, len(certificates))
+	for hostname := range certificates {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
+
+// crtListExtension ends the names of generated crt-list files
+const crtListExtension = ".crt-list"
+
+// crtListPath returns where haproxy finds the crt-list file of a TLS listener
+func (h *HaproxyConfigurator) crtListPath(listener *haproxyListener) string {
+	return path.Join(h.CertificateDir, listener.name+crtListExtension)
+}
+
+// crtList renders the default certificate, then one line per hostname: the certificate, its TLS
+// options and the SNI filter
+func (h *HaproxyConfigurator) crtList(listener *haproxyListener) string {
+	hostnames := sortedCertificateHostnames(listener.certificates)
+	if len(hostnames) == 0 {
+		return ""
+	}
+
+	// haproxy serves the first line, with its options, to clients without SNI. Those get the bind
+	// defaults, so the line has no options; without an entry for them the negative filter keeps the
+	// certificate's own names from shadowing their hostname's options.
+	var lines = listener.certificates[hostnames[0]].Path
+	if hostnames[0] != "" {
+		lines += " !*"
+	}
+	lines += "\n"
+
+	for _, hostname := range hostnames {
+		if hostname == "" {
+			continue
 		}
-		sort.Slice(ports, func(i int, j int) bool { return ports[i] < ports[j] })
-		return ports
+		certificate := listener.certificates[hostname]
+		line := []string{certificate.Path}
+		entryOptions := certificate.Options
+		if !h.Version.supports(featureCrtListSSLVersion) {
+			// Validation only lets hostnames repeat the version bound of the bind line
+			entryOptions.MinVersion = ""
+		}
+		options := entryOptions.arguments()
+		if len(options) > 0 {
+			line = append(line, "["+strings.Join(options, " ")+"]")
+		}
+		line = append(line, hostname)
+		lines += strings.Join(line, " ") + "\n"
 	}
-	sortBackendMap := func(inner map[string]*HaproxyBackend) []string {
-		backends := make([]string, 0, len(inner))
-		for name := range inner {
-			backends = append(backends, name)
+	return lines
+}
+
+// CertificateFiles renders the crt-list file of every TLS listener, by file name in CertificateDir
+func (h *HaproxyConfigurator) CertificateFiles() map[string][]byte {
+	var files = map[string][]byte{}
+	for _, listenIP := range h.sortedListenIPs() {
+		for _, listener := range h.desiredConfig.listenIPs[listenIP] {
+			if listener.useSSL {
+				files[path.Base(h.crtListPath(listener))] = []byte(h.crtList(listener))
+			}
 		}
-		sort.Strings(backends)
-		return backends
 	}
+	return files
+}
+
+// sortedUserlists returns the userlists by name for determinism
+func (h *HaproxyConfigurator) sortedUserlists() []*HaproxyUserlist {
+	names := make([]string, 0, len(h.desiredConfig.userlists))
+	for name := range h.desiredConfig.userlists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	userlists := make([]*HaproxyUserlist, 0, len(names))
+	for _, name := range names {
+		userlists = append(userlists, h.desiredConfig.userlists[name])
+	}
+	return userlists
+}
+
+func sortedRedirects(redirects map[string]uint16) []string {
+	hostnames := make([]string, 0, len(redirects))
+	for hostname := range redirects {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
+
+// Render the haproxy configuration
+func (h *HaproxyConfigurator) Render() string {
+	return h.ConfigFile().String()
+}
+
+// ConfigFile builds the sections of the haproxy configuration
+func (h *HaproxyConfigurator) ConfigFile() *HaproxyConfigFile {
+	var file = &HaproxyConfigFile{}
+	ips := h.sortedListenIPs()
+
+	// Build Userlists
+	for _, userlist := range h.sortedUserlists() {
+		section := NewHaproxySection("userlist", userlist.Name)
+		for _, user := range userlist.Users {
+			section.Add("user", user.Name, "password", user.Password)
+		}
+		file.Add(section)
+	}
+
 	// Build Front-Ends
 	for _, listenIP := range ips {
 		innerMap := h.desiredConfig.listenIPs[listenIP]
 		for _, port := range sortListenerMap(innerMap) {
-			listener := innerMap[port]
-			config += "frontend " + listener.name + "\n"
-			config += "    mode " + listener.mode + "\n"
-			config += "    bind " + listenIP + ":" + strconv.Itoa(int(port))
-			if listener.useSSL {
-				sort.Strings(listener.sslCertificates)
-				config += " ssl"
-				var previous = ""
-				sort.Strings(listener.sslCertificates)
-				for _, certificate := range listener.sslCertificates {
-					if previous != certificate {
-						config += " crt " + certificate
-						previous = certificate
-					}
-				}
-				config += "\n"
-				if listener.mode == "http" {
-					config += "    reqadd x-forwarded-proto:\\ https"
-				}
-			}
-			config += "\n"
-			config += "\n"
-			if listener.mode == "http" {
-				for _, hostname := range sortBackendMap(listener.hostnameBackends) {
-					backend := listener.hostnameBackends[hostname]
-					config += "    # Set up backend selection for " + hostname + "\n"
-					config += "    use_backend " + backend.Name + " if { hdr(host) -i " + hostname + " }\n"
-					config += "    use_backend " + backend.Name + " if { hdr(host) -i " + hostname + ":" + strconv.Itoa(int(port)) + " }\n"
-				}
-			} else if listener.mode == "tcp" {
-				config += "    # Set up default_backend\n"
-				config += "    default_backend " + listener.hostnameBackends["_"].Name + "\n"
-			}
-			config += "\n"
+			file.Add(h.frontendSection(listenIP, port, innerMap[port]))
 		}
 	}
 
 	// Build Back-Ends
+	// Several routes can share a backend, but it must only be defined once
+	var renderedBackends = map[string]bool{}
 	for _, listenIP := range ips {
 		innerMap := h.desiredConfig.listenIPs[listenIP]
 		for _, port := range sortListenerMap(innerMap) {
 			listener := innerMap[port]
-			for _, name := range sortBackendMap(listener.hostnameBackends) {
-				backend := listener.hostnameBackends[name]
-				config += "backend " + backend.Name + "\n"
-				config += "    mode " + listener.mode + "\n"
-				config += "    balance " + backend.BalanceMethod + "\n"
-				config += "\n"
-				config += "    # Backend Servers\n"
-				sort.Slice(backend.Backends, func(i, j int) bool { return backend.Backends[i].Name < backend.Backends[j].Name })
-				for _, backendServer := range backend.Backends {
-					config += "    server " + backendServer.Name + " " + backendServer.IP + ":" + strconv.Itoa(int(backendServer.Port))
-					config += " check"
-					if backend.UseSSL {
-						config += " ssl"
-						if !backend.VerifySSL {
-							config += " verify none"
-						}
-					}
-					config += "\n"
+			for _, route := range sortBackendMap(listener.routeBackends) {
+				backend := listener.routeBackends[route]
+				if renderedBackends[backend.Name] {
+					continue
 				}
-				config += "\n"
+				renderedBackends[backend.Name] = true
+				file.Add(h.backendSection(listener.mode, backend))
+			}
+		}
+	}
+
+	return file
+}
+
+func (h *HaproxyConfigurator) frontendSection(listenIP string, port uint16, listener *haproxyListener) *HaproxySection {
+	section := NewHaproxySection("frontend", listener.name)
+	section.Add("mode", listener.mode)
+
+	bind := []string{"bind", listenIP + ":" + strconv.Itoa(int(port))}
+	if listener.useSSL {
+		bind = append(bind, "ssl", "crt-list", h.crtListPath(listener))
+		bind = append(bind, h.SSLDefaults.arguments()...)
+	}
+	section.Add(bind...)
+	if listener.mode == "http" {
+		section.Add("option", "forwardfor")
+		if listener.useSSL {
+			section.Add("http-request", "set-header", "X-Forwarded-Proto", "https")
+		}
+	}
+	section.AddBlank()
+
+	for _, hostname := range sortedRedirects(listener.redirects) {
+		section.AddComment("Redirect " + hostname + " to HTTPS")
+		var httpsURL = "https://" + hostname
+		if httpsPort := listener.redirects[hostname]; httpsPort == 443 {
+			section.Add("http-request", "redirect", "scheme", "https", "code", "301", "if", "{ hdr(host) -i "+hostname+" }")
+		} else {
+			httpsURL += ":" + strconv.Itoa(int(httpsPort))
+			section.Add("http-request", "redirect", "prefix", httpsURL, "code", "301", "if", "{ hdr(host) -i "+hostname+" }")
+		}
+		// A Host header with an explicit port needs the authority replaced, not only the scheme
+		section.Add("http-request", "redirect", "prefix", httpsURL, "code", "301", "if", "{ hdr(host) -i "+hostname+":"+strconv.Itoa(int(port))+" }")
+	}
+
+	if listener.sniPassthrough {
+		section.AddComment("Wait for the TLS client hello to route by SNI")
+		section.Add("tcp-request", "inspect-delay", sniInspectDelay)
+	}
+	addClientVerification(section, port, listener)
+	addAccessLists(section, port, listener)
+	addBasicAuth(section, port, listener)
+
+	if listener.mode == "http" {
+		for _, route := range sortBackendMap(listener.routeBackends) {
+			backend := listener.routeBackends[route]
+			section.AddComment("Set up backend selection for " + route.hostname + route.pathPrefix + route.pathRegex)
+			section.Add("use_backend", backend.Name, "if", "{ hdr(host) -i "+route.hostname+" }"+routePathCondition(route))
+			section.Add("use_backend", backend.Name, "if", "{ hdr(host) -i "+route.hostname+":"+strconv.Itoa(int(port))+" }"+routePathCondition(route))
+		}
+	} else if listener.sniPassthrough {
+		section.Add("tcp-request", "content", "accept", "if", "{ req_ssl_hello_type 1 }")
+		for _, route := range sortBackendMap(listener.routeBackends) {
+			section.AddComment("Set up backend selection for " + route.hostname)
+			section.Add("use_backend", listener.routeBackends[route].Name, "if", "{ req.ssl_sni -i "+route.hostname+" }")
+		}
+	} else if listener.mode == "tcp" {
+		section.AddComment("Set up default_backend")
+		section.Add("default_backend", listener.routeBackends[haproxyRoute{hostname: "_"}].Name)
+	}
+	return section
+}
+
+// routePathCondition returns the path part of the route's condition, starting with a space
+func routePathCondition(route haproxyRoute) string {
+	if route.pathPrefix != "" {
+		return " { path_beg " + route.pathPrefix + " }"
+	}
+	if route.pathRegex != "" {
+		return " { path_reg " + route.pathRegex + " }"
+	}
+	return ""
+}
+
+// routeMatchCondition returns the path part of the condition matching exactly the requests the route's
+// use_backend receives, starting with a space: its own path, but none of the routes of the hostname
+// matched before it
+func routeMatchCondition(routes []haproxyRoute, route haproxyRoute) string {
+	var condition = routePathCondition(route)
+	for _, earlier := range routes {
+		if earlier == route {
+			break
+		}
+		if earlier.hostname == route.hostname {
+			condition += " !" + strings.TrimPrefix(routePathCondition(earlier), " ")
+		}
+	}
+	return condition
+}
+
+// addAccessLists rejects clients outside the allow list or inside the deny list of a route; in 'http'
+// mode the rules apply to the requests the route's use_backend receives
+func addAccessLists(section *HaproxySection, port uint16, listener *haproxyListener) {
+	var definedACLs = map[string]bool{}
+	routes := sortBackendMap(listener.routeBackends)
+	for _, route := range routes {
+		accessList, exists := listener.accessLists[route]
+		if !exists {
+			continue
+		}
+		backend := listener.routeBackends[route]
+		allowed, denied := backend.Name+"_allowed", backend.Name+"_denied"
+		if listener.mode == "tcp" && !listener.sniPassthrough {
+			section.AddComment("Restrict client IPs")
+		} else {
+			section.AddComment("Restrict client IPs for " + route.hostname + route.pathPrefix + route.pathRegex)
+		}
+		if len(accessList.allow) > 0 && !definedACLs[allowed] {
+			definedACLs[allowed] = true
+			section.Add(append([]string{"acl", allowed, "src"}, accessList.allow...)...)
+		}
+		if len(accessList.deny) > 0 && !definedACLs[denied] {
+			definedACLs[denied] = true
+			section.Add(append([]string{"acl", denied, "src"}, accessList.deny...)...)
+		}
+
+		var conditions = []string{}
+		if len(accessList.allow) > 0 {
+			conditions = append(conditions, "!"+allowed)
+		}
+		if len(accessList.deny) > 0 {
+			conditions = append(conditions, denied)
+		}
+		for _, condition := range conditions {
+			if listener.sniPassthrough {
+				// Before the client hello is accepted, so the rule waits for the SNI
+				section.Add("tcp-request", "content", "reject", "if", "{ req.ssl_sni -i "+route.hostname+" }", condition)
+				continue
+			}
+			if listener.mode == "tcp" {
+				section.Add("tcp-request", "connection", "reject", "if", condition)
+				continue
+			}
+			section.Add("http-request", "deny", "if", "{ hdr(host) -i "+route.hostname+" }"+routeMatchCondition(routes, route), condition)
+			section.Add("http-request", "deny", "if", "{ hdr(host) -i "+route.hostname+":"+strconv.Itoa(int(port))+" }"+routeMatchCondition(routes, route), condition)
+		}
+	}
+}
+
+// addClientVerification denies requests for hostnames verifying client certificates unless they came through
+// the hostname's own SNI, as crt-list options only apply to the handshake, and passes the subject header
+func addClientVerification(section *HaproxySection, port uint16, listener *haproxyListener) {
+	for _, hostname := range sortedCertificateHostnames(listener.certificates) {
+		if listener.certificates[hostname].Options.CAFile == "" {
+			continue
+		}
+		sni := "{ ssl_fc_sni -i " + hostname + " }"
+		section.AddComment("Require the client certificate of " + hostname + " to be verified through its SNI")
+		section.Add("http-request", "deny", "if", "{ hdr(host) -i "+hostname+" }", "!"+sni)
+		section.Add("http-request", "deny", "if", "{ hdr(host) -i "+hostname+":"+strconv.Itoa(int(port))+" }", "!"+sni)
+		if header, exists := listener.clientDNHeaders[hostname]; exists {
+			section.Add("http-request", "set-header", header, "%[ssl_c_s_dn]", "if", sni, "{ ssl_c_used }")
+			section.Add("http-request", "del-header", header, "if", sni, "!{ ssl_c_used }")
+		}
+	}
+}
+
+// addBasicAuth asks for credentials on the requests the use_backend of a route with basic authentication receives
+func addBasicAuth(section *HaproxySection, port uint16, listener *haproxyListener) {
+	var definedACLs = map[string]bool{}
+	routes := sortBackendMap(listener.routeBackends)
+	for _, route := range routes {
+		auth, exists := listener.basicAuth[route]
+		if !exists {
+			continue
+		}
+		authenticated := auth.Userlist.Name + "_authenticated"
+		section.AddComment("Require authentication for " + route.hostname + route.pathPrefix + route.pathRegex)
+		if !definedACLs[authenticated] {
+			definedACLs[authenticated] = true
+			section.Add("acl", authenticated, "http_auth("+auth.Userlist.Name+")")
+		}
+		section.Add("http-request", "auth", "realm", auth.Realm, "if", "{ hdr(host) -i "+route.hostname+" }"+routeMatchCondition(routes, route), "!"+authenticated)
+		section.Add("http-request", "auth", "realm", auth.Realm, "if", "{ hdr(host) -i "+route.hostname+":"+strconv.Itoa(int(port))+" }"+routeMatchCondition(routes, route), "!"+authenticated)
+	}
+}
+
+func (h *HaproxyConfigurator) backendSection(mode string, backend *HaproxyBackend) *HaproxySection {
+	section := NewHaproxySection("backend", backend.Name)
+	section.Add("mode", mode)
+	section.Add("balance", backend.BalanceMethod)
+	if backend.Timeouts.Server != "" {
+		section.Add("timeout", "server", backend.Timeouts.Server)
+	}
+	if backend.Timeouts.Tunnel != "" {
+		section.Add("timeout", "tunnel", backend.Timeouts.Tunnel)
+	}
+	if backend.Timeouts.Queue != "" {
+		section.Add("timeout", "queue", backend.Timeouts.Queue)
+	}
+	switch backend.Stickiness.Mode {
+	case sessionAffinityCookie:
+		section.Add("cookie", backend.Stickiness.CookieName, "insert", "indirect", "nocache")
+	case sessionAffinitySource:
+		section.Add("stick-table", "type", "ip", "size", "1m", "expire", backend.Stickiness.Expire)
+		section.Add("stick", "on", "src")
+	}
+	if backend.HSTSMaxAge > 0 {
+		section.Add("http-response", "set-header", "Strict-Transport-Security", "max-age="+strconv.Itoa(backend.HSTSMaxAge))
+	}
+	if healthCheck := backend.HealthCheck; healthCheck.HTTPPath != "" {
+		var method = "GET"
+		if healthCheck.HTTPMethod != "" {
+			method = healthCheck.HTTPMethod
+		}
+		if h.Version.supports(featureHTTPCheckSend) {
+			section.Add("option", "httpchk")
+			send := []string{"http-check", "send", "meth", method, "uri", healthCheck.HTTPPath}
+			if healthCheck.HTTPHost != "" {
+				send = append(send, "ver", "HTTP/1.1", "hdr", "Host", healthCheck.HTTPHost)
 			}
+			section.Add(send...)
+		} else if healthCheck.HTTPHost != "" {
+			// Before http-check send, headers could only be smuggled in after the version
+			section.Add("option", "httpchk", method, healthCheck.HTTPPath, "HTTP/1.1\\r\\nHost:\\ "+healthCheck.HTTPHost)
+		} else {
+			section.Add("option", "httpchk", method, healthCheck.HTTPPath)
+		}
+		if len(healthCheck.Expect) > 0 {
+			section.Add(append([]string{"http-check", "expect"}, healthCheck.Expect...)...)
 		}
 	}
+	section.AddBlank()
 
-	return config
+	section.AddComment("Backend Servers")
+	sort.Slice(backend.Backends, func(i, j int) bool { return backend.Backends[i].Name < backend.Backends[j].Name })
+	for _, backendServer := range backend.Backends {
+		server := []string{"server", backendServer.Name, backendServer.IP + ":" + strconv.Itoa(int(backendServer.Port)), "check"}
+		if backend.HealthCheck.Port != 0 {
+			server = append(server, "port", strconv.Itoa(int(backend.HealthCheck.Port)))
+		}
+		if backend.HealthCheck.Interval != "" {
+			server = append(server, "inter", backend.HealthCheck.Interval)
+		}
+		if backend.HealthCheck.Rise != 0 {
+			server = append(server, "rise", strconv.Itoa(backend.HealthCheck.Rise))
+		}
+		if backend.HealthCheck.Fall != 0 {
+			server = append(server, "fall", strconv.Itoa(backend.HealthCheck.Fall))
+		}
+		if backend.Stickiness.Mode == sessionAffinityCookie {
+			server = append(server, "cookie", backendServer.Name)
+		}
+		if backend.MaxConn > 0 {
+			server = append(server, "maxconn", strconv.Itoa(backend.MaxConn))
+		}
+		if backendServer.Backup {
+			server = append(server, "backup")
+		}
+		if backend.UseSSL {
+			server = append(server, "ssl")
+			if !backend.VerifySSL {
+				server = append(server, "verify", "none")
+			}
+			if backend.HealthCheck.PlainText {
+				server = append(server, "no-check-ssl")
+			}
+		}
+		section.Add(server...)
+	}
+	return section
 }
@@ -0,0 +1,372 @@
+package haproxyconfigurator
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of TestRender")
+
+// newTestConfigurator returns an initialized configurator targeting the version
+func newTestConfigurator(t *testing.T, version string) *HaproxyConfigurator {
+	h := &HaproxyConfigurator{}
+	h.Initialize()
+	parsed, err := ParseHaproxyVersion(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Version = parsed
+	return h
+}
+
+// addTestListeners adds the listeners, failing the test when one is rejected
+func addTestListeners(t *testing.T, h *HaproxyConfigurator, listeners ...HaproxyListenerConfig) {
+	for _, listener := range listeners {
+		if !h.AddListener(listener) {
+			t.Fatalf("listener %s for %s was rejected", listener.Name, listener.Backend.Name)
+		}
+	}
+}
+
+// testBackend returns a round robin backend with one server
+func testBackend(name string, port int32) HaproxyBackend {
+	return HaproxyBackend{
+		Name:          name,
+		BalanceMethod: "roundrobin",
+		Backends:      []HaproxyBackendTarget{{Name: "node-1", IP: "10.0.0.1", Port: port}},
+	}
+}
+
+// testRoute returns a plain HTTP listener on port 80 routing the hostname and path to the backend
+func testRoute(hostname string, pathPrefix string, pathRegex string, backend string) HaproxyListenerConfig {
+	return HaproxyListenerConfig{Name: listenerName("*", 80), ListenIP: "*", ListenPort: 80, Mode: "http",
+		Hostname: hostname, PathPrefix: pathPrefix, PathRegex: pathRegex, Backend: testBackend(backend, 30080)}
+}
+
+// renderFixture is a set of listeners whose rendered configuration is kept in testdata/render-<name>.cfg
+type renderFixture struct {
+	name      string
+	version   string
+	listeners []HaproxyListenerConfig
+}
+
+// renderFixtures returns the listeners of the golden configurations
+func renderFixtures() []renderFixture {
+	postgres := testBackend("k8s-service_default_postgres_pg_backend", 30432)
+	postgres.Timeouts = HaproxyTimeouts{Server: "1h", Tunnel: "1h", Queue: "5s"}
+	postgres.MaxConn = 100
+	// Rules of the hostname's catch-all route must leave the requests of its other routes alone
+	www := testRoute("www.example.com", "", "", "k8s-service_default_www_http_backend")
+	www.AllowCIDRs = []string{"10.0.0.0/8"}
+	admin := testRoute("www.example.com", "/admin", "", "k8s-service_default_admin_http_backend")
+	admin.DenyCIDRs = []string{"192.0.2.0/24"}
+	admin.BasicAuth = &HaproxyBasicAuth{Realm: "Admin", Userlist: &HaproxyUserlist{
+		Name:  "k8s-secret_default_users_users",
+		Users: []HaproxyUser{{Name: "alice", Password: "rl0uE5SKpKQvA"}},
+	}}
+	www.BasicAuth = &HaproxyBasicAuth{Realm: "Staff", Userlist: &HaproxyUserlist{
+		Name:  "k8s-secret_default_staff_users",
+		Users: []HaproxyUser{{Name: "bob", Password: "rl0uE5SKpKQvA"}},
+	}}
+	shop := testBackend("k8s-service_default_shop_https_backend", 30443)
+	shop.HealthCheck = HaproxyHealthCheck{HTTPPath: "/healthz", Expect: []string{"!", "status", "500"}}
+	shop.HSTSMaxAge = 31536000
+
+	return []renderFixture{
+		{"tcp", "2.0", []HaproxyListenerConfig{
+			{Name: listenerName("10.1.1.1", 5432), ListenIP: "10.1.1.1", ListenPort: 5432, Mode: "tcp", AllowCIDRs: []string{"10.0.0.0/8"},
+				Backend: postgres},
+		}},
+		{"http-routes", "2.0", []HaproxyListenerConfig{
+			www,
+			admin,
+			testRoute("api.example.com", "", "^/v[0-9]+/", "k8s-service_default_api_http_backend"),
+		}},
+		{"https-1.8", "1.8", []HaproxyListenerConfig{
+			{Name: listenerName("*", 443), ListenIP: "*", ListenPort: 443, Mode: "http", Hostname: "shop.example.com",
+				SslCertificate: "/etc/haproxy/ssl/shop.example.com.pem", RedirectHTTPListener: listenerName("*", httpRedirectPort),
+				Backend: shop},
+		}},
+		{"https-2.2", "2.2", []HaproxyListenerConfig{
+			{Name: listenerName("*", 443), ListenIP: "*", ListenPort: 443, Mode: "http", Hostname: "shop.example.com",
+				SslCertificate: "/etc/haproxy/ssl/shop.example.com.pem", RedirectHTTPListener: listenerName("*", httpRedirectPort),
+				SslOptions: HaproxySSLOptions{MinVersion: "TLSv1.3", Ciphersuites: "TLS_AES_256_GCM_SHA384"},
+				Backend:    shop},
+		}},
+		{"sni-passthrough", "2.0", []HaproxyListenerConfig{
+			testPassthroughRoute("a.example.com", "k8s-service_default_a_https_backend"),
+			testPassthroughRoute("b.example.com", "k8s-service_default_b_https_backend"),
+		}},
+	}
+}
+
+func TestRender(t *testing.T) {
+	for _, test := range renderFixtures() {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestConfigurator(t, test.version)
+			addTestListeners(t, h, test.listeners...)
+			rendered := h.Render()
+			golden := filepath.Join("testdata", "render-"+test.name+".cfg")
+			if *update {
+				if err := ioutil.WriteFile(golden, []byte(rendered), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rendered != string(expected) {
+				t.Errorf("rendered configuration differs from %s (rerun with -update to accept it):\n%s", golden, rendered)
+			}
+		})
+	}
+}
+
+// testHTTPSRoute returns a TLS listener on port 443 for the hostname, redirecting HTTP requests to it
+func testHTTPSRoute(hostname string, backend string) HaproxyListenerConfig {
+	return HaproxyListenerConfig{Name: listenerName("*", 443), ListenIP: "*", ListenPort: 443, Mode: "http", Hostname: hostname,
+		SslCertificate: "/etc/haproxy/ssl/" + hostname + ".pem", RedirectHTTPListener: listenerName("*", httpRedirectPort),
+		Backend: testBackend(backend, 30443)}
+}
+
+// testPassthroughRoute returns a TCP listener on port 443 passing TLS connections for the hostname through
+func testPassthroughRoute(hostname string, backend string) HaproxyListenerConfig {
+	return HaproxyListenerConfig{Name: listenerName("*", 443), ListenIP: "*", ListenPort: 443, Mode: "tcp", Hostname: hostname,
+		SNIPassthrough: true, Backend: testBackend(backend, 30443)}
+}
+
+func TestPassthroughValidation(t *testing.T) {
+	withCertificate := testPassthroughRoute("c.example.com", "c")
+	withCertificate.SslCertificate = "/etc/haproxy/ssl/c.pem"
+	plain := testPassthroughRoute("c.example.com", "c")
+	plain.SNIPassthrough = false
+
+	for _, test := range []struct {
+		name     string
+		listener HaproxyListenerConfig
+		valid    bool
+	}{
+		{"other hostname", testPassthroughRoute("c.example.com", "c"), true},
+		{"claimed hostname", testPassthroughRoute("a.example.com", "c"), false},
+		{"without hostname", testPassthroughRoute("", "c"), false},
+		{"with SSL", withCertificate, false},
+		{"plain TCP on the port", plain, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestConfigurator(t, "2.0")
+			addTestListeners(t, h, testPassthroughRoute("a.example.com", "a"))
+			if added := h.AddListener(test.listener); added != test.valid {
+				t.Errorf("expected valid %v, got %v", test.valid, added)
+			}
+		})
+	}
+}
+
+func TestRedirectValidation(t *testing.T) {
+	plain := testRoute("shop.example.com", "", "", "shop")
+	plain.RedirectHTTPListener = listenerName("*", httpRedirectPort)
+	hsts := testRoute("shop.example.com", "", "", "shop")
+	hsts.Backend.HSTSMaxAge = 600
+	samePort := testHTTPSRoute("shop.example.com", "shop")
+	samePort.ListenPort = httpRedirectPort
+	otherPort := testHTTPSRoute("www.example.com", "www")
+	otherPort.Name, otherPort.ListenPort = listenerName("*", 8443), 8443
+
+	for _, test := range []struct {
+		name     string
+		listener HaproxyListenerConfig
+		valid    bool
+	}{
+		{"redirect", testHTTPSRoute("shop.example.com", "shop"), true},
+		{"without SSL", plain, false},
+		{"HSTS without SSL", hsts, false},
+		{"same port", samePort, false},
+		{"routed on port 80", testHTTPSRoute("api.example.com", "api"), false},
+		{"redirected to another port", otherPort, false},
+		{"without hostname", testHTTPSRoute("", "shop"), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestConfigurator(t, "2.0")
+			addTestListeners(t, h,
+				testRoute("api.example.com", "", "", "api"),
+				testHTTPSRoute("www.example.com", "www"),
+			)
+			if added := h.AddListener(test.listener); added != test.valid {
+				t.Errorf("expected valid %v, got %v", test.valid, added)
+			}
+		})
+	}
+}
+
+func TestAccessListValidation(t *testing.T) {
+	for _, test := range []struct {
+		allow []string
+		deny  []string
+		valid bool
+	}{
+		{[]string{"10.0.0.0/8", "192.0.2.1"}, nil, true},
+		{nil, []string{"2001:db8::/32"}, true},
+		{[]string{"10.0.0.0/33"}, nil, false},
+		{nil, []string{"office"}, false},
+	} {
+		listener := testRoute("www.example.com", "", "", "www")
+		listener.AllowCIDRs, listener.DenyCIDRs = test.allow, test.deny
+		if added := newTestConfigurator(t, "2.0").AddListener(listener); added != test.valid {
+			t.Errorf("allow %v deny %v: expected valid %v, got %v", test.allow, test.deny, test.valid, added)
+		}
+	}
+}
+
+func TestPathRouting(t *testing.T) {
+	h := newTestConfigurator(t, "2.0")
+	addTestListeners(t, h,
+		testRoute("b.example.com", "", "", "b"),
+		testRoute("a.example.com", "", "", "a"),
+		testRoute("a.example.com", "/api", "", "a-api"),
+		testRoute("a.example.com", "/api/v2", "", "a-api-v2"),
+		testRoute("a.example.com", "/app", "", "a-app"),
+		testRoute("a.example.com", "", "^/static/", "a-static"),
+		testRoute("a.example.com", "", "\\.png$", "a-png"),
+	)
+
+	// Only the rule matching the Host header without a port is compared
+	var rules = []string{}
+	for _, line := range strings.Split(h.Render(), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "use_backend") && !strings.Contains(line, ":80 }") {
+			rules = append(rules, strings.TrimSpace(line))
+		}
+	}
+	expected := []string{
+		"use_backend a-png if { hdr(host) -i a.example.com } { path_reg \\.png$ }",
+		"use_backend a-static if { hdr(host) -i a.example.com } { path_reg ^/static/ }",
+		"use_backend a-api-v2 if { hdr(host) -i a.example.com } { path_beg /api/v2 }",
+		"use_backend a-api if { hdr(host) -i a.example.com } { path_beg /api }",
+		"use_backend a-app if { hdr(host) -i a.example.com } { path_beg /app }",
+		"use_backend a if { hdr(host) -i a.example.com }",
+		"use_backend b if { hdr(host) -i b.example.com }",
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("expected rules\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(rules, "\n"))
+	}
+}
+
+func TestPathRoutingValidation(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		listener HaproxyListenerConfig
+		valid    bool
+	}{
+		{"same route and backend", testRoute("a.example.com", "/api", "", "a-api"), true},
+		{"other path", testRoute("a.example.com", "/api/v2", "", "other"), true},
+		{"claimed route", testRoute("a.example.com", "/api", "", "other"), false},
+		{"claimed hostname", testRoute("a.example.com", "", "", "other"), false},
+		{"relative prefix", testRoute("b.example.com", "api", "", "other"), false},
+		{"prefix and regex", testRoute("b.example.com", "/api", "^/api", "other"), false},
+		{"invalid regex", testRoute("b.example.com", "", "^/(api", "other"), false},
+		{"whitespace", testRoute("b.example.com", "/my api", "", "other"), false},
+		{"tcp", HaproxyListenerConfig{Name: listenerName("*", 5432), ListenIP: "*", ListenPort: 5432, Mode: "tcp",
+			PathPrefix: "/api", Backend: testBackend("other", 30432)}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestConfigurator(t, "2.0")
+			addTestListeners(t, h,
+				testRoute("a.example.com", "", "", "a"),
+				testRoute("a.example.com", "/api", "", "a-api"),
+			)
+			if added := h.AddListener(test.listener); added != test.valid {
+				t.Errorf("expected valid %v, got %v", test.valid, added)
+			}
+		})
+	}
+}
+
+func TestCrtList(t *testing.T) {
+	verification := HaproxySSLOptions{ALPN: "h2,http/1.1", Verify: "required", CAFile: "/etc/haproxy/ssl/ca.pem"}
+	for _, test := range []struct {
+		name      string
+		version   string
+		defaults  HaproxySSLOptions
+		hostname  string
+		options   HaproxySSLOptions
+		noSNICert bool
+		expected  string
+	}{
+		{"plain", "2.0", HaproxySSLOptions{}, "b.example.com", HaproxySSLOptions{}, false,
+			"/etc/haproxy/ssl/a.pem !*\n/etc/haproxy/ssl/a.pem a.example.com\n/etc/haproxy/ssl/b.pem b.example.com\n"},
+		{"options", "2.0", HaproxySSLOptions{MinVersion: "TLSv1.1"}, "b.example.com", HaproxySSLOptions{ALPN: "h2,http/1.1", MinVersion: "TLSv1.2"}, false,
+			"/etc/haproxy/ssl/a.pem !*\n/etc/haproxy/ssl/a.pem a.example.com\n/etc/haproxy/ssl/b.pem [alpn h2,http/1.1 ssl-min-ver TLSv1.2] b.example.com\n"},
+		{"ssl-min-ver before 1.9", "1.8", HaproxySSLOptions{MinVersion: "TLSv1.2"}, "b.example.com", HaproxySSLOptions{ALPN: "h2,http/1.1", MinVersion: "TLSv1.2"}, false,
+			"/etc/haproxy/ssl/a.pem !*\n/etc/haproxy/ssl/a.pem a.example.com\n/etc/haproxy/ssl/b.pem [alpn h2,http/1.1] b.example.com\n"},
+		{"options on the first hostname", "2.0", HaproxySSLOptions{}, "a.example.com", verification, false,
+			"/etc/haproxy/ssl/a.pem !*\n/etc/haproxy/ssl/a.pem [alpn h2,http/1.1 verify required ca-file /etc/haproxy/ssl/ca.pem] a.example.com\n/etc/haproxy/ssl/b.pem b.example.com\n"},
+		{"certificate without hostname", "2.0", HaproxySSLOptions{}, "a.example.com", verification, true,
+			"/etc/haproxy/ssl/default.pem\n/etc/haproxy/ssl/a.pem [alpn h2,http/1.1 verify required ca-file /etc/haproxy/ssl/ca.pem] a.example.com\n/etc/haproxy/ssl/b.pem b.example.com\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestConfigurator(t, test.version)
+			h.SSLDefaults = test.defaults
+			listeners := []HaproxyListenerConfig{
+				{Name: listenerName("*", 443), ListenIP: "*", ListenPort: 443, Mode: "http", Hostname: "b.example.com",
+					SslCertificate: "/etc/haproxy/ssl/b.pem", Backend: testBackend("b", 30001)},
+				{Name: listenerName("*", 443), ListenIP: "*", ListenPort: 443, Mode: "http", Hostname: "a.example.com",
+					SslCertificate: "/etc/haproxy/ssl/a.pem", Backend: testBackend("a", 30000)},
+			}
+			for i := range listeners {
+				if listeners[i].Hostname == test.hostname {
+					listeners[i].SslOptions = test.options
+				}
+			}
+			if test.noSNICert {
+				listeners = append(listeners, HaproxyListenerConfig{Name: listenerName("*", 443), ListenIP: "*", ListenPort: 443, Mode: "http",
+					SslCertificate: "/etc/haproxy/ssl/default.pem", Backend: testBackend("default", 30002)})
+			}
+			addTestListeners(t, h, listeners...)
+			files := h.CertificateFiles()
+			if len(files) != 1 {
+				t.Fatalf("expected one crt-list, got %d", len(files))
+			}
+			crtList, exists := files[listenerName("*", 443)+crtListExtension]
+			if !exists {
+				t.Fatalf("expected the crt-list of %s, got %v", listenerName("*", 443), files)
+			}
+			if string(crtList) != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, crtList)
+			}
+		})
+	}
+}
+
+func TestSSLOptionsRequireHostname(t *testing.T) {
+	h := newTestConfigurator(t, "2.0")
+	listener := HaproxyListenerConfig{Name: listenerName("*", 443), ListenIP: "*", ListenPort: 443, Mode: "http",
+		SslCertificate: "/etc/haproxy/ssl/default.pem", SslOptions: HaproxySSLOptions{ALPN: "h2,http/1.1"}, Backend: testBackend("default", 30000)}
+	if h.AddListener(listener) {
+		t.Error("expected TLS options without a hostname to be rejected")
+	}
+}
+
+func TestSSLMinVersionBefore19(t *testing.T) {
+	listener := HaproxyListenerConfig{Name: listenerName("*", 443), ListenIP: "*", ListenPort: 443, Mode: "http", Hostname: "a.example.com",
+		SslCertificate: "/etc/haproxy/ssl/a.pem", SslOptions: HaproxySSLOptions{MinVersion: "TLSv1.2"}, Backend: testBackend("a", 30000)}
+	for _, test := range []struct {
+		version  string
+		defaults string
+		valid    bool
+	}{
+		{"1.8", "TLSv1.2", true},
+		{"1.8", "TLSv1.0", false},
+		{"1.8", "", false},
+		{"1.9", "TLSv1.0", true},
+	} {
+		h := newTestConfigurator(t, test.version)
+		h.SSLDefaults.MinVersion = test.defaults
+		if added := h.AddListener(listener); added != test.valid {
+			t.Errorf("%s with --ssl-min-ver %q: expected valid %v, got %v", test.version, test.defaults, test.valid, added)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package haproxyconfigurator
+
+import (
+	"sort"
+	"strings"
+)
+
+// Section types in the order they are written to the configuration file
+var haproxySectionOrder = []string{"global", "defaults", "userlist", "resolvers", "frontend", "backend"}
+
+// HaproxyDirective is a single line of a section: a directive, a comment or a blank line
+type HaproxyDirective struct {
+	Words   []string
+	Comment string
+}
+
+// String renders the directive without indentation
+func (d HaproxyDirective) String() string {
+	if d.Comment != "" {
+		return "# " + d.Comment
+	}
+	return strings.Join(d.Words, " ")
+}
+
+// HaproxySection is a global, defaults, userlist, resolvers, frontend or backend section
+type HaproxySection struct {
+	Type       string
+	Name       string
+	Directives []HaproxyDirective
+}
+
+// NewHaproxySection creates an empty section; global and defaults sections may be unnamed
+func NewHaproxySection(sectionType string, name string) *HaproxySection {
+	return &HaproxySection{Type: sectionType, Name: name}
+}
+
+// Add appends a directive made of words, e.g. Add("balance", "roundrobin")
+func (s *HaproxySection) Add(words ...string) {
+	s.Directives = append(s.Directives, HaproxyDirective{Words: words})
+}
+
+// AddComment appends a comment line
+func (s *HaproxySection) AddComment(comment string) {
+	s.Directives = append(s.Directives, HaproxyDirective{Comment: comment})
+}
+
+// AddBlank appends an empty line to group directives
+func (s *HaproxySection) AddBlank() {
+	s.Directives = append(s.Directives, HaproxyDirective{})
+}
+
+// String renders the section followed by an empty line
+func (s *HaproxySection) String() string {
+	var config = s.Type
+	if s.Name != "" {
+		config += " " + s.Name
+	}
+	config += "\n"
+	for _, directive := range s.Directives {
+		if line := directive.String(); line != "" {
+			config += "    " + line
+		}
+		config += "\n"
+	}
+	return config + "\n"
+}
+
+// HaproxyConfigFile is an haproxy configuration made of sections
+type HaproxyConfigFile struct {
+	Sections []*HaproxySection
+}
+
+// Add appends a section
+func (f *HaproxyConfigFile) Add(section *HaproxySection) {
+	f.Sections = append(f.Sections, section)
+}
+
+func sectionRank(sectionType string) int {
+	for rank, t := range haproxySectionOrder {
+		if t == sectionType {
+			return rank
+		}
+	}
+	return len(haproxySectionOrder)
+}
+
+// String serializes the sections grouped by type, keeping the order they were added in within a type
+func (f *HaproxyConfigFile) String() string {
+	sections := make([]*HaproxySection, len(f.Sections))
+	copy(sections, f.Sections)
+	sort.SliceStable(sections, func(i int, j int) bool {
+		return sectionRank(sections[i].Type) < sectionRank(sections[j].Type)
+	})
+	var config = ""
+	for _, section := range sections {
+		config += section.String()
+	}
+	return config
+}
@@ -0,0 +1,44 @@
+package haproxyconfigurator
+
+import "testing"
+
+func TestConfigFileString(t *testing.T) {
+	backend := NewHaproxySection("backend", "app")
+	backend.Add("balance", "roundrobin")
+	backend.AddBlank()
+	backend.AddComment("Backend Servers")
+	backend.Add("server", "node-1", "10.0.0.1:30080", "check")
+	frontend := NewHaproxySection("frontend", "http")
+	frontend.Add("bind", "*:80")
+	defaults := NewHaproxySection("defaults", "")
+	defaults.Add("mode", "http")
+	userlist := NewHaproxySection("userlist", "users")
+	userlist.Add("user", "alice", "password", "rl0uE5SKpKQvA")
+
+	// Sections are grouped by type, keeping the order they were added in within a type
+	file := &HaproxyConfigFile{}
+	for _, section := range []*HaproxySection{backend, frontend, NewHaproxySection("backend", "empty"), defaults, userlist} {
+		file.Add(section)
+	}
+	expected := `defaults
+    mode http
+
+userlist users
+    user alice password rl0uE5SKpKQvA
+
+frontend http
+    bind *:80
+
+backend app
+    balance roundrobin
+
+    # Backend Servers
+    server node-1 10.0.0.1:30080 check
+
+backend empty
+
+`
+	if rendered := file.String(); rendered != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, rendered)
+	}
+}
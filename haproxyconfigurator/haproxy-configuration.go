@@ -4,15 +4,63 @@ package haproxyconfigurator
 type haproxyConfig struct {
 	// Listen IP -> Backend
 	listenIPs map[string]map[uint16]*haproxyListener
+	// Userlist Name -> Userlist
+	userlists map[string]*HaproxyUserlist
 }
 
 type haproxyListener struct {
-	name            string
-	mode            string
-	sslCertificates []string
-	// Hostname -> Backend Target
-	hostnameBackends map[string]*HaproxyBackend
-	useSSL           bool
+	name string
+	mode string
+	// Hostname -> Certificate served for it, "" for clients without SNI
+	certificates map[string]HaproxyCertificate
+	// Route -> Backend Target
+	routeBackends map[haproxyRoute]*HaproxyBackend
+	useSSL        bool
+	// Hostname -> HTTPS port requests for the hostname are redirected to
+	redirects map[string]uint16
+	// Route -> Client IPs allowed and denied
+	accessLists map[haproxyRoute]haproxyAccessList
+	// Route -> Basic authentication
+	basicAuth map[haproxyRoute]*HaproxyBasicAuth
+	// Hostname -> Request header passing the client certificate subject
+	clientDNHeaders map[string]string
+	// sniPassthrough routes 'tcp' mode connections by the SNI of their TLS client hello, without terminating TLS
+	sniPassthrough bool
+}
+
+// haproxyAccessList restricts the client IPs of a route; an empty allow list allows everyone not denied
+type haproxyAccessList struct {
+	allow []string
+	deny  []string
+}
+
+// HaproxyCertificate is a certificate served by a TLS listener, with the TLS options of its crt-list entry
+type HaproxyCertificate struct {
+	Path    string
+	Options HaproxySSLOptions
+}
+
+// HaproxySSLOptions are TLS settings of a crt-list entry; empty values keep haproxy's defaults
+type HaproxySSLOptions struct {
+	// ALPN are the comma separated protocols offered, e.g. "h2,http/1.1"
+	ALPN string
+	// MinVersion is the oldest TLS version accepted, e.g. "TLSv1.2"
+	MinVersion string
+	// Ciphers is the OpenSSL cipher list of TLSv1.2 and older, e.g. "ECDHE+AESGCM:!aNULL"
+	Ciphers string
+	// Ciphersuites are the TLSv1.3 cipher suites, e.g. "TLS_AES_128_GCM_SHA256"; haproxy 1.9 or newer
+	Ciphersuites string
+	// Verify is the client certificate verification, "none", "optional" or "required"
+	Verify string
+	// CAFile is the CA bundle client certificates are verified against
+	CAFile string
+}
+
+// haproxyRoute identifies the requests of a listener sent to one backend
+type haproxyRoute struct {
+	hostname   string
+	pathPrefix string
+	pathRegex  string
 }
 
 // HaproxyBackend defines an haproxy backend
@@ -22,11 +70,109 @@ type HaproxyBackend struct {
 	BalanceMethod string
 	UseSSL        bool
 	VerifySSL     bool
+	HealthCheck   HaproxyHealthCheck
+	Timeouts      HaproxyTimeouts
+	Stickiness    HaproxyStickiness
+	// MaxConn limits the concurrent connections of each server when above zero; the rest wait in the queue
+	MaxConn int
+	// HSTSMaxAge adds a Strict-Transport-Security header to responses when above zero
+	HSTSMaxAge int
+	Source     HaproxyBackendSource
+}
+
+// HaproxyBackendSource describes the kubernetes object a backend was generated from
+type HaproxyBackendSource struct {
+	// Kind is "Service" or "Ingress"
+	Kind      string
+	Namespace string
+	Name      string
+	// Port is the name of the service port
+	Port        string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// Annotation returns a haproxy-kubefigurator annotation of the source, scoped to the port for services
+func (s HaproxyBackendSource) Annotation(name string) string {
+	if s.Kind == "Service" {
+		return s.Annotations["haproxy-kubefigurator."+s.Port+"."+name]
+	}
+	return s.Annotations["haproxy-kubefigurator."+name]
+}
+
+// HaproxyHealthCheck defines how haproxy checks backend servers
+type HaproxyHealthCheck struct {
+	// Port overrides the server port checks are sent to
+	Port int32
+	// HTTPMethod is the method of HTTP checks (default GET)
+	HTTPMethod string
+	// HTTPPath enables HTTP checks against the path
+	HTTPPath string
+	// HTTPHost is sent as the Host header of HTTP checks
+	HTTPHost string
+	// Expect are the words of the http-check expect rule, e.g. ["status", "200"]
+	Expect []string
+	// Interval is the haproxy time between checks, e.g. "2s"
+	Interval string
+	// Rise and Fall are the consecutive checks needed to mark a server up or down
+	Rise int
+	Fall int
+	// PlainText sends checks without TLS even if the backend uses TLS
+	PlainText bool
+}
+
+// HaproxyTimeouts overrides the timeouts of a backend with haproxy times like "30s"; empty keeps the defaults
+type HaproxyTimeouts struct {
+	// Server is the longest a server may stay inactive during a request
+	Server string
+	// Tunnel is the longest a websocket or tcp tunnel may stay inactive
+	Tunnel string
+	// Queue is the longest a request may wait for a server below its maxconn
+	Queue string
+}
+
+// HaproxyStickiness defines how clients keep being sent to the same backend server
+type HaproxyStickiness struct {
+	// Mode is "cookie", "source" or empty for no stickiness
+	Mode string
+	// CookieName is the cookie inserted in cookie mode; its value is the server name
+	CookieName string
+	// Expire is the haproxy time a client IP is remembered in source mode
+	Expire string
+}
+
+// HaproxyBasicAuth requires requests to authenticate as one of the users of a userlist
+type HaproxyBasicAuth struct {
+	Realm    string
+	Userlist *HaproxyUserlist
+}
+
+// HaproxyUserlist defines an haproxy userlist section
+type HaproxyUserlist struct {
+	Name  string
+	Users []HaproxyUser
+}
+
+// HaproxyUser is a user of a userlist with a crypt(3) password hash
+type HaproxyUser struct {
+	Name     string
+	Password string
 }
 
 // HaproxyBackendTarget defines a backend target for haproxy
 type HaproxyBackendTarget struct {
-	Name string
-	IP   string
-	Port int32
+	// Name is the node or pod name, which is also the value of sticky session cookies
+	Name   string
+	IP     string
+	Port   int32
+	Backup bool
+}
+
+// certificatePaths returns the certificate files of the listener, sorted
+func (l *haproxyListener) certificatePaths() []string {
+	paths := []string{}
+	for _, certificate := range l.certificates {
+		paths = append(paths, certificate.Path)
+	}
+	return uniqueSorted(paths)
 }
@@ -0,0 +1,77 @@
+package haproxyconfigurator
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// HaproxyVersion is the major and minor version of the haproxy the configuration targets
+type HaproxyVersion struct {
+	Major int
+	Minor int
+}
+
+// oldestHaproxyVersion is the oldest haproxy generated configurations are valid for
+var oldestHaproxyVersion = HaproxyVersion{1, 8}
+
+// ParseHaproxyVersion parses versions like "1.8", "2.4" or "2.4.22"
+func ParseHaproxyVersion(version string) (HaproxyVersion, error) {
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 {
+		return HaproxyVersion{}, errors.New("Invalid haproxy version (" + version + ") specified - expected <major>.<minor>")
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return HaproxyVersion{}, errors.New("Invalid haproxy version (" + version + ") specified - expected <major>.<minor>")
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return HaproxyVersion{}, errors.New("Invalid haproxy version (" + version + ") specified - expected <major>.<minor>")
+	}
+	parsed := HaproxyVersion{major, minor}
+	if !parsed.AtLeast(oldestHaproxyVersion.Major, oldestHaproxyVersion.Minor) {
+		return HaproxyVersion{}, errors.New("Unsupported haproxy version (" + version + ") specified - the oldest supported version is " + oldestHaproxyVersion.String())
+	}
+	return parsed, nil
+}
+
+// AtLeast reports whether the version is major.minor or newer
+func (v HaproxyVersion) AtLeast(major int, minor int) bool {
+	return v.Major > major || v.Major == major && v.Minor >= minor
+}
+
+func (v HaproxyVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// haproxyFeature is a directive dialect that differs between haproxy versions
+type haproxyFeature string
+
+const (
+	// featureHTTPCheckSend builds check requests with http-check send instead of the option httpchk arguments
+	featureHTTPCheckSend haproxyFeature = "http-check send"
+	// featureCiphersuites configures the TLSv1.3 cipher suites, separately from the ciphers of older versions
+	featureCiphersuites haproxyFeature = "ciphersuites"
+	// featureCrtListSSLVersion sets ssl-min-ver per crt-list entry, which 1.8 only accepts when built with BoringSSL
+	featureCrtListSSLVersion haproxyFeature = "crt-list ssl-min-ver"
+)
+
+// haproxyVersionRange is the range of versions a feature is generated for
+type haproxyVersionRange struct {
+	since HaproxyVersion
+}
+
+// haproxyCompatibility is the compatibility table deciding which dialect is generated for each version.
+var haproxyCompatibility = map[haproxyFeature]haproxyVersionRange{
+	featureHTTPCheckSend:     {since: HaproxyVersion{2, 2}},
+	featureCiphersuites:      {since: HaproxyVersion{1, 9}},
+	featureCrtListSSLVersion: {since: HaproxyVersion{1, 9}},
+}
+
+// supports reports whether the feature is generated for the version
+func (v HaproxyVersion) supports(feature haproxyFeature) bool {
+	versions, known := haproxyCompatibility[feature]
+	return known && v.AtLeast(versions.since.Major, versions.since.Minor)
+}
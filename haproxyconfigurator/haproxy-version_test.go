@@ -0,0 +1,48 @@
+package haproxyconfigurator
+
+import "testing"
+
+func TestParseHaproxyVersion(t *testing.T) {
+	for _, test := range []struct {
+		version  string
+		expected HaproxyVersion
+		invalid  bool
+	}{
+		{"1.8", HaproxyVersion{1, 8}, false},
+		{"2.0", HaproxyVersion{2, 0}, false},
+		{"2.4.22", HaproxyVersion{2, 4}, false},
+		{"1.7", HaproxyVersion{}, true},
+		{"2", HaproxyVersion{}, true},
+		{"two.four", HaproxyVersion{}, true},
+		{"2.x", HaproxyVersion{}, true},
+	} {
+		version, err := ParseHaproxyVersion(test.version)
+		if (err != nil) != test.invalid {
+			t.Errorf("%q: expected invalid %v, got %v", test.version, test.invalid, err)
+			continue
+		}
+		if version != test.expected {
+			t.Errorf("%q: expected %s, got %s", test.version, test.expected, version)
+		}
+	}
+}
+
+func TestSupports(t *testing.T) {
+	for _, test := range []struct {
+		version  HaproxyVersion
+		feature  haproxyFeature
+		expected bool
+	}{
+		{HaproxyVersion{2, 1}, featureHTTPCheckSend, false},
+		{HaproxyVersion{2, 2}, featureHTTPCheckSend, true},
+		{HaproxyVersion{1, 8}, featureCiphersuites, false},
+		{HaproxyVersion{1, 9}, featureCiphersuites, true},
+		{HaproxyVersion{1, 8}, featureCrtListSSLVersion, false},
+		{HaproxyVersion{1, 9}, featureCrtListSSLVersion, true},
+		{HaproxyVersion{3, 0}, haproxyFeature("unknown"), false},
+	} {
+		if supported := test.version.supports(test.feature); supported != test.expected {
+			t.Errorf("%s %s: expected %v, got %v", test.version, test.feature, test.expected, supported)
+		}
+	}
+}
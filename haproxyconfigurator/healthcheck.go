@@ -0,0 +1,97 @@
+package haproxyconfigurator
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var httpMethodPattern = regexp.MustCompile(`^[A-Z]+$`)
+
+// healthCheckExpectMatches are the matches http-check expect accepts on every supported version
+var healthCheckExpectMatches = []string{"status", "rstatus", "string", "rstring"}
+
+// parseHealthCheck reads the health-check-* annotations of a service port or ingress
+func parseHealthCheck(anno func(name string) string) (HaproxyHealthCheck, error) {
+	var healthCheck = HaproxyHealthCheck{
+		HTTPMethod: anno("health-check-method"),
+		HTTPPath:   anno("health-check-path"),
+		HTTPHost:   anno("health-check-host"),
+		Interval:   anno("health-check-interval"),
+	}
+
+	if healthCheck.HTTPPath != "" && (!strings.HasPrefix(healthCheck.HTTPPath, "/") || strings.ContainsAny(healthCheck.HTTPPath, " \t")) {
+		return healthCheck, errors.New("Invalid health-check-path (" + healthCheck.HTTPPath + ") specified - it must start with '/' and cannot contain whitespace")
+	}
+	if healthCheck.HTTPPath == "" && (healthCheck.HTTPMethod != "" || healthCheck.HTTPHost != "" || anno("health-check-expect") != "") {
+		return healthCheck, errors.New("health-check-method, health-check-host and health-check-expect require a health-check-path")
+	}
+	if healthCheck.HTTPMethod != "" && !httpMethodPattern.MatchString(healthCheck.HTTPMethod) {
+		return healthCheck, errors.New("Invalid health-check-method (" + healthCheck.HTTPMethod + ") specified - expected an uppercase HTTP method like 'GET'")
+	}
+	if strings.ContainsAny(healthCheck.HTTPHost, " \t") {
+		return healthCheck, errors.New("Invalid health-check-host (" + healthCheck.HTTPHost + ") specified - it cannot contain whitespace")
+	}
+	if healthCheck.Interval != "" {
+		if err := validateHaproxyTime("health-check-interval", healthCheck.Interval); err != nil {
+			return healthCheck, err
+		}
+	}
+
+	if expect := anno("health-check-expect"); expect != "" {
+		words := strings.Fields(expect)
+		// The negation may be written apart or attached to the match, but haproxy wants its own word
+		var negation = []string{}
+		if len(words) > 0 && strings.HasPrefix(words[0], "!") {
+			negation = []string{"!"}
+			if words[0] == "!" {
+				words = words[1:]
+			} else {
+				words[0] = strings.TrimPrefix(words[0], "!")
+			}
+		}
+		// A bare status code is the common case
+		if len(words) == 1 {
+			if _, err := strconv.Atoi(words[0]); err == nil {
+				words = []string{"status", words[0]}
+			}
+		}
+		if len(words) < 2 || !contains(healthCheckExpectMatches, words[0]) {
+			return healthCheck, errors.New("Invalid health-check-expect (" + expect + ") specified - expected a status code or '[!] <match> <pattern>' with match 'status', 'rstatus', 'string' or 'rstring'")
+		}
+		healthCheck.Expect = append(negation, words...)
+	}
+
+	if port := anno("health-check-port"); port != "" {
+		checkPort, err := strconv.Atoi(port)
+		if err != nil || checkPort < 1 || checkPort > 65535 {
+			return healthCheck, errors.New("Invalid health-check-port (" + port + ") specified - expected a port number")
+		}
+		healthCheck.Port = int32(checkPort)
+	}
+
+	for _, threshold := range []struct {
+		name  string
+		value *int
+	}{{"health-check-rise", &healthCheck.Rise}, {"health-check-fall", &healthCheck.Fall}} {
+		if count := anno(threshold.name); count != "" {
+			parsed, err := strconv.Atoi(count)
+			if err != nil || parsed < 1 {
+				return healthCheck, errors.New("Invalid " + threshold.name + " (" + count + ") specified - expected a positive number of checks")
+			}
+			*threshold.value = parsed
+		}
+	}
+
+	return healthCheck, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
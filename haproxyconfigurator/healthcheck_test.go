@@ -0,0 +1,60 @@
+package haproxyconfigurator
+
+import (
+	"reflect"
+	"testing"
+)
+
+// annotations returns an anno function reading the map
+func annotations(values map[string]string) func(name string) string {
+	return func(name string) string { return values[name] }
+}
+
+func TestParseHealthCheck(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		annotations map[string]string
+		expected    HaproxyHealthCheck
+		invalid     bool
+	}{
+		{"none", map[string]string{}, HaproxyHealthCheck{}, false},
+		{"path", map[string]string{"health-check-path": "/healthz"}, HaproxyHealthCheck{HTTPPath: "/healthz"}, false},
+		{"relative path", map[string]string{"health-check-path": "healthz"}, HaproxyHealthCheck{}, true},
+		{"method without path", map[string]string{"health-check-method": "HEAD"}, HaproxyHealthCheck{}, true},
+		{"lowercase method", map[string]string{"health-check-path": "/", "health-check-method": "get"}, HaproxyHealthCheck{}, true},
+		{"status code", map[string]string{"health-check-path": "/", "health-check-expect": "204"},
+			HaproxyHealthCheck{HTTPPath: "/", Expect: []string{"status", "204"}}, false},
+		{"match", map[string]string{"health-check-path": "/", "health-check-expect": "rstring ^ok$"},
+			HaproxyHealthCheck{HTTPPath: "/", Expect: []string{"rstring", "^ok$"}}, false},
+		{"negation apart", map[string]string{"health-check-path": "/", "health-check-expect": "! string down"},
+			HaproxyHealthCheck{HTTPPath: "/", Expect: []string{"!", "string", "down"}}, false},
+		{"negation attached", map[string]string{"health-check-path": "/", "health-check-expect": "!status 500"},
+			HaproxyHealthCheck{HTTPPath: "/", Expect: []string{"!", "status", "500"}}, false},
+		{"negated status code", map[string]string{"health-check-path": "/", "health-check-expect": "!500"},
+			HaproxyHealthCheck{HTTPPath: "/", Expect: []string{"!", "status", "500"}}, false},
+		{"unknown match", map[string]string{"health-check-path": "/", "health-check-expect": "header ok"}, HaproxyHealthCheck{}, true},
+		{"whitespace expect", map[string]string{"health-check-path": "/", "health-check-expect": " "}, HaproxyHealthCheck{}, true},
+		{"port", map[string]string{"health-check-port": "8080"}, HaproxyHealthCheck{Port: 8080}, false},
+		{"port out of range", map[string]string{"health-check-port": "70000"}, HaproxyHealthCheck{}, true},
+		{"thresholds", map[string]string{"health-check-rise": "3", "health-check-fall": "2"}, HaproxyHealthCheck{Rise: 3, Fall: 2}, false},
+		{"zero threshold", map[string]string{"health-check-rise": "0"}, HaproxyHealthCheck{}, true},
+		{"interval", map[string]string{"health-check-interval": "5s"}, HaproxyHealthCheck{Interval: "5s"}, false},
+		{"invalid interval", map[string]string{"health-check-interval": "5 seconds"}, HaproxyHealthCheck{}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			healthCheck, err := parseHealthCheck(annotations(test.annotations))
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", healthCheck)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(healthCheck, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, healthCheck)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package haproxyconfigurator
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const ingressClassAnnotation = "kubernetes.io/ingress.class"
+
+type ingressWrapper extensionsv1beta1.Ingress
+
+// anno returns an ingress-wide annotation; unlike services these are not scoped to a port
+func (i ingressWrapper) anno(name string) string {
+	return i.Annotations["haproxy-kubefigurator."+name]
+}
+
+func (i ingressWrapper) label() string {
+	return "ingress " + i.Namespace + "/" + i.Name
+}
+
+func ingressMatchesClass(ingress *extensionsv1beta1.Ingress, options GeneratorOptions) bool {
+	return options.IngressClass != "" && ingress.Annotations[ingressClassAnnotation] == options.IngressClass
+}
+
+// ingressBackends lists every backend referenced by the ingress
+func ingressBackends(ingress *extensionsv1beta1.Ingress) []extensionsv1beta1.IngressBackend {
+	backends := []extensionsv1beta1.IngressBackend{}
+	if ingress.Spec.Backend != nil {
+		backends = append(backends, *ingress.Spec.Backend)
+	}
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			backends = append(backends, path.Backend)
+		}
+	}
+	return backends
+}
+
+// serviceReferencedByIngress reports whether an ingress of the configured class routes to the service
+func serviceReferencedByIngress(cache *kubernetesCache, service *v1.Service, options GeneratorOptions) bool {
+	for _, ingress := range cache.listIngresses() {
+		if ingress.Namespace != service.Namespace || !ingressMatchesClass(ingress, options) {
+			continue
+		}
+		for _, backend := range ingressBackends(ingress) {
+			if backend.ServiceName == service.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveIngressBackend finds the service port an ingress backend refers to
+func resolveIngressBackend(cache *kubernetesCache, namespace string, backend extensionsv1beta1.IngressBackend) (serviceWrapper, servicePortWrapper, error) {
+	svc, exists := cache.getService(namespace, backend.ServiceName)
+	if !exists {
+		return serviceWrapper{}, servicePortWrapper{}, errors.New("Service " + namespace + "/" + backend.ServiceName + " does not exist")
+	}
+	service := serviceWrapper(*svc)
+	for _, p := range service.Spec.Ports {
+		if backend.ServicePort.Type == intstr.String && p.Name == backend.ServicePort.StrVal ||
+			backend.ServicePort.Type == intstr.Int && p.Port == backend.ServicePort.IntVal {
+			return service, servicePortWrapper(p), nil
+		}
+	}
+	return service, servicePortWrapper{}, errors.New("Service " + namespace + "/" + backend.ServiceName + " has no port " + backend.ServicePort.String())
+}
+
+// addIngressListeners routes the host and path rules of every ingress of the configured class
+// and adds the certificates synced from their TLS secrets to certificates
+func addIngressListeners(configurator *HaproxyConfigurator, cache *kubernetesCache, nodes kubernetesNodes, certificates certificateFiles, options GeneratorOptions) {
+	for _, ing := range cache.listIngresses() {
+		if !ingressMatchesClass(ing, options) {
+			continue
+		}
+		ingress := ingressWrapper(*ing)
+		if ingress.Spec.Backend != nil {
+			logger.Warnf("Ignoring the default backend of %s; only rules with a host are supported", ingress.label())
+		}
+
+		// Host -> Secret holding its certificate, or "" for a certificate provisioned on the load balancers
+		var tlsHosts = map[string]string{}
+		for _, tls := range ingress.Spec.TLS {
+			for _, host := range tls.Hosts {
+				tlsHosts[host] = tls.SecretName
+			}
+		}
+
+		var listenIP = "*"
+		if lIP := ingress.anno("listen-ip"); lIP != "" {
+			listenIP = lIP
+		}
+
+		var backendBalanceMethod = "roundrobin"
+		if balanceMethod := ingress.anno("backends-balance-method"); balanceMethod != "" {
+			backendBalanceMethod = balanceMethod
+		}
+
+		hstsMaxAge, err := parseHSTSMaxAge(ingress.anno("hsts-max-age"))
+		if err != nil {
+			reportInvalidService(ingress.label(), []string{err.Error()})
+			continue
+		}
+
+		timeouts, err := parseTimeouts(ingress.anno)
+		if err != nil {
+			reportInvalidService(ingress.label(), []string{err.Error()})
+			continue
+		}
+
+		maxConn, err := parseMaxConn(ingress.anno("backends-maxconn"))
+		if err != nil {
+			reportInvalidService(ingress.label(), []string{err.Error()})
+			continue
+		}
+
+		auth, err := basicAuth(cache, ingress.Namespace, ingress.anno)
+		if err != nil {
+			reportInvalidService(ingress.label(), []string{err.Error()})
+			continue
+		}
+
+		for _, rule := range ingress.Spec.Rules {
+			if rule.Host == "" {
+				reportInvalidService(ingress.label(), []string{"Rules without a host are not supported"})
+				continue
+			}
+			// Hosts are matched exactly and name their backends
+			if strings.Contains(rule.Host, "*") {
+				reportInvalidService(ingress.label(), []string{"Wildcard host (" + rule.Host + ") is not supported"})
+				continue
+			}
+			if rule.HTTP == nil {
+				continue
+			}
+
+			// Hosts covered by a TLS section are served on 443, every other host on 80
+			var listenPort = uint16(80)
+			var sslCertificate = ""
+			var redirectHTTPListener = ""
+			var hostHSTSMaxAge = 0
+			var hostCertificates = certificateFiles{}
+			var hostSslOptions = HaproxySSLOptions{}
+			var hostClientDNHeader = ""
+			if secretName, exists := tlsHosts[rule.Host]; exists {
+				listenPort = 443
+				hostSslOptions = parseSSLOptions(ingress.anno)
+				var err error
+				hostSslOptions.Verify, hostSslOptions.CAFile, err = clientVerification(cache, hostCertificates, options, ingress.Namespace, ingress.anno)
+				if err != nil {
+					reportInvalidService(ingress.label(), []string{err.Error()})
+					continue
+				}
+				hostClientDNHeader = ingress.anno("client-dn-header")
+				if secretName != "" {
+					fileName, err := secretCertificate(cache, hostCertificates, ingress.Namespace, secretName)
+					if err != nil {
+						reportInvalidService(ingress.label(), []string{err.Error()})
+						continue
+					}
+					sslCertificate = certificatePath(options, fileName)
+				} else if sslCertificate, err = provisionedCertificate(options, rule.Host+".pem"); err != nil {
+					reportInvalidService(ingress.label(), []string{err.Error()})
+					continue
+				}
+				if ingress.anno("redirect-http") == "true" {
+					redirectHTTPListener = listenerName(listenIP, httpRedirectPort)
+				}
+				hostHSTSMaxAge = hstsMaxAge
+			}
+
+			for _, path := range rule.HTTP.Paths {
+				service, port, err := resolveIngressBackend(cache, ingress.Namespace, path.Backend)
+				if err != nil {
+					reportInvalidService(ingress.label(), []string{err.Error()})
+					continue
+				}
+				targets, err := serviceBackendTargets(cache, nodes, service, port, options)
+				if err != nil {
+					reportInvalidService(ingress.label(), []string{err.Error()})
+					continue
+				}
+
+				healthCheck, err := serviceHealthCheck(service, port, options, ingress.anno)
+				if err != nil {
+					reportInvalidService(ingress.label(), []string{err.Error()})
+					continue
+				}
+				stickiness, err := serviceStickiness(service, ingress.anno)
+				if err != nil {
+					reportInvalidService(ingress.label(), []string{err.Error()})
+					continue
+				}
+
+				// Hosts get a backend each, since TLS and HSTS settings are per host even when the service is shared
+				var portName = port.Name
+				if portName == "" {
+					portName = strconv.Itoa(int(port.Port))
+				}
+				var pathPrefix = path.Path
+				if pathPrefix == "/" {
+					pathPrefix = ""
+				}
+
+				added := configurator.AddListener(
+					HaproxyListenerConfig{
+						Name:                 listenerName(listenIP, listenPort),
+						ListenIP:             listenIP,
+						ListenPort:           listenPort,
+						Mode:                 "http",
+						Hostname:             rule.Host,
+						PathPrefix:           pathPrefix,
+						SslCertificate:       sslCertificate,
+						SslOptions:           hostSslOptions,
+						ClientDNHeader:       hostClientDNHeader,
+						AllowCIDRs:           annotationList(ingress.anno("allow-cidrs")),
+						DenyCIDRs:            annotationList(ingress.anno("deny-cidrs")),
+						BasicAuth:            auth,
+						RedirectHTTPListener: redirectHTTPListener,
+						Backend: HaproxyBackend{
+							Name:          "k8s-ingress_" + ingress.Namespace + "_" + ingress.Name + "_" + rule.Host + "_" + service.Name + "_" + portName + "_backend",
+							Backends:      targets,
+							BalanceMethod: backendBalanceMethod,
+							UseSSL:        ingress.anno("backends-use-ssl") == "true",
+							VerifySSL:     ingress.anno("backends-verify-ssl") == "true",
+							HealthCheck:   healthCheck,
+							Timeouts:      timeouts,
+							Stickiness:    stickiness,
+							MaxConn:       maxConn,
+							HSTSMaxAge:    hostHSTSMaxAge,
+							Source: HaproxyBackendSource{
+								Kind:        "Ingress",
+								Namespace:   ingress.Namespace,
+								Name:        ingress.Name,
+								Port:        port.Name,
+								Labels:      ingress.Labels,
+								Annotations: ingress.Annotations,
+							},
+						},
+					},
+				)
+				if added {
+					for name, data := range hostCertificates {
+						certificates[name] = data
+					}
+				}
+			}
+		}
+	}
+}
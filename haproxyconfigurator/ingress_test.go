@@ -0,0 +1,190 @@
+package haproxyconfigurator
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// newTestCache returns a cache holding the objects, as if listed from the API server
+func newTestCache(t *testing.T, objects ...runtime.Object) *kubernetesCache {
+	newStore := func(kind string) *objectStore {
+		return &objectStore{kind: kind, objects: map[string]runtime.Object{}}
+	}
+	cache := &kubernetesCache{
+		nodes:      newStore("nodes"),
+		services:   newStore("services"),
+		endpoints:  newStore("endpoints"),
+		secrets:    &lazyStore{store: newStore("secrets")},
+		configMaps: &lazyStore{store: newStore("configmaps")},
+		ingresses:  newStore("ingresses"),
+	}
+	for _, obj := range objects {
+		var store *objectStore
+		switch obj.(type) {
+		case *v1.Node:
+			store = cache.nodes
+		case *v1.Service:
+			store = cache.services
+		case *v1.Endpoints:
+			store = cache.endpoints
+		case *v1.Secret:
+			store = cache.secrets.store
+		case *v1.ConfigMap:
+			store = cache.configMaps.store
+		case *extensionsv1beta1.Ingress:
+			store = cache.ingresses
+		default:
+			t.Fatalf("unexpected %T in the cache", obj)
+		}
+		key, _, err := objectKey(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.objects[key] = obj
+	}
+	return cache
+}
+
+// testIngressRule routes the paths of host to services, by path
+func testIngressRule(host string, paths map[string]extensionsv1beta1.IngressBackend) extensionsv1beta1.IngressRule {
+	rule := extensionsv1beta1.IngressRule{Host: host, IngressRuleValue: extensionsv1beta1.IngressRuleValue{
+		HTTP: &extensionsv1beta1.HTTPIngressRuleValue{},
+	}}
+	for path, backend := range paths {
+		rule.HTTP.Paths = append(rule.HTTP.Paths, extensionsv1beta1.HTTPIngressPath{Path: path, Backend: backend})
+	}
+	return rule
+}
+
+// ingressRoutes describes the routes of a configurator as "<port> <hostname><path prefix>" -> backend
+// name, and its certificates as "<port> <hostname>" -> path
+func ingressRoutes(h *HaproxyConfigurator) (map[string]string, map[string]string) {
+	routes, certificates := map[string]string{}, map[string]string{}
+	for port, listener := range h.desiredConfig.listenIPs["*"] {
+		for route, backend := range listener.routeBackends {
+			routes[strconv.Itoa(int(port))+" "+route.hostname+route.pathPrefix] = backend.Name
+		}
+		for hostname, certificate := range listener.certificates {
+			certificates[strconv.Itoa(int(port))+" "+hostname] = certificate.Path
+		}
+	}
+	return routes, certificates
+}
+
+func TestAddIngressListeners(t *testing.T) {
+	web := extensionsv1beta1.IngressBackend{ServiceName: "web", ServicePort: intstr.FromString("http")}
+	api := extensionsv1beta1.IngressBackend{ServiceName: "api", ServicePort: intstr.FromInt(8080)}
+	services := []runtime.Object{
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+			Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80, NodePort: 30080}}}},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "api"},
+			Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 8080, NodePort: 30081}}}},
+	}
+	for _, test := range []struct {
+		name         string
+		rules        []extensionsv1beta1.IngressRule
+		tls          []extensionsv1beta1.IngressTLS
+		routes       map[string]string
+		certificates map[string]string
+	}{
+		{
+			name:  "plain host",
+			rules: []extensionsv1beta1.IngressRule{testIngressRule("www.example.com", map[string]extensionsv1beta1.IngressBackend{"/": web})},
+			routes: map[string]string{
+				"80 www.example.com": "k8s-ingress_default_site_www.example.com_web_http_backend",
+			},
+			certificates: map[string]string{},
+		},
+		{
+			name:  "paths map to prefixes",
+			rules: []extensionsv1beta1.IngressRule{testIngressRule("www.example.com", map[string]extensionsv1beta1.IngressBackend{"/": web, "/api": api, "": web})},
+			routes: map[string]string{
+				"80 www.example.com":     "k8s-ingress_default_site_www.example.com_web_http_backend",
+				"80 www.example.com/api": "k8s-ingress_default_site_www.example.com_api_8080_backend",
+			},
+			certificates: map[string]string{},
+		},
+		{
+			name: "TLS and plain hosts",
+			rules: []extensionsv1beta1.IngressRule{
+				testIngressRule("www.example.com", map[string]extensionsv1beta1.IngressBackend{"/": web}),
+				testIngressRule("shop.example.com", map[string]extensionsv1beta1.IngressBackend{"/": web}),
+			},
+			tls: []extensionsv1beta1.IngressTLS{{Hosts: []string{"www.example.com"}}},
+			routes: map[string]string{
+				"443 www.example.com": "k8s-ingress_default_site_www.example.com_web_http_backend",
+				"80 shop.example.com": "k8s-ingress_default_site_shop.example.com_web_http_backend",
+			},
+			certificates: map[string]string{
+				"443 www.example.com": "/etc/haproxy/ssl/www.example.com.pem",
+			},
+		},
+		{
+			name: "hosts sharing a service get a backend each",
+			rules: []extensionsv1beta1.IngressRule{
+				testIngressRule("www.example.com", map[string]extensionsv1beta1.IngressBackend{"/": web, "/api": api}),
+				testIngressRule("shop.example.com", map[string]extensionsv1beta1.IngressBackend{"/api": api}),
+			},
+			tls: []extensionsv1beta1.IngressTLS{{Hosts: []string{"www.example.com", "shop.example.com"}}},
+			routes: map[string]string{
+				"443 www.example.com":      "k8s-ingress_default_site_www.example.com_web_http_backend",
+				"443 www.example.com/api":  "k8s-ingress_default_site_www.example.com_api_8080_backend",
+				"443 shop.example.com/api": "k8s-ingress_default_site_shop.example.com_api_8080_backend",
+			},
+			certificates: map[string]string{
+				"443 www.example.com":  "/etc/haproxy/ssl/www.example.com.pem",
+				"443 shop.example.com": "/etc/haproxy/ssl/shop.example.com.pem",
+			},
+		},
+		{
+			name: "wildcard and missing hosts are rejected",
+			rules: []extensionsv1beta1.IngressRule{
+				testIngressRule("*.example.com", map[string]extensionsv1beta1.IngressBackend{"/": web}),
+				testIngressRule("", map[string]extensionsv1beta1.IngressBackend{"/": web}),
+				testIngressRule("www.example.com", map[string]extensionsv1beta1.IngressBackend{"/": web}),
+			},
+			tls: []extensionsv1beta1.IngressTLS{{Hosts: []string{"*.example.com"}}},
+			routes: map[string]string{
+				"80 www.example.com": "k8s-ingress_default_site_www.example.com_web_http_backend",
+			},
+			certificates: map[string]string{},
+		},
+		{
+			name:         "missing service",
+			rules:        []extensionsv1beta1.IngressRule{testIngressRule("www.example.com", map[string]extensionsv1beta1.IngressBackend{"/": {ServiceName: "missing", ServicePort: intstr.FromInt(80)}})},
+			routes:       map[string]string{},
+			certificates: map[string]string{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ingress := &extensionsv1beta1.Ingress{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "site", Annotations: map[string]string{ingressClassAnnotation: "haproxy"}},
+				Spec:       extensionsv1beta1.IngressSpec{Rules: test.rules, TLS: test.tls},
+			}
+			other := &extensionsv1beta1.Ingress{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "other", Annotations: map[string]string{ingressClassAnnotation: "nginx"}},
+				Spec:       extensionsv1beta1.IngressSpec{Rules: []extensionsv1beta1.IngressRule{testIngressRule("other.example.com", map[string]extensionsv1beta1.IngressBackend{"/": web})}},
+			}
+			cache := newTestCache(t, append(services, ingress, other)...)
+			h := newTestConfigurator(t, "2.0")
+			options := GeneratorOptions{IngressClass: "haproxy", CertificateDir: "/etc/haproxy/ssl"}
+			nodes := kubernetesNodes{"node-1": {IP: "10.0.0.1"}}
+
+			addIngressListeners(h, cache, nodes, certificateFiles{}, options)
+			routes, certificates := ingressRoutes(h)
+			if !reflect.DeepEqual(routes, test.routes) {
+				t.Errorf("expected routes %v, got %v", test.routes, routes)
+			}
+			if !reflect.DeepEqual(certificates, test.certificates) {
+				t.Errorf("expected certificates %v, got %v", test.certificates, certificates)
+			}
+		})
+	}
+}
@@ -1,15 +1,38 @@
 package haproxyconfigurator
 
 import (
+	"reflect"
+	"sync"
 	"time"
 
 	"k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-type kubernetesNodeIPs map[string]string
+// kubernetesNode holds what the generator needs to know about a node
+type kubernetesNode struct {
+	IP     string
+	Labels labels.Set
+}
+
+// kubernetesNodes maps node names to nodes
+type kubernetesNodes map[string]kubernetesNode
+
+// matching returns the nodes selected by selector
+func (n kubernetesNodes) matching(selector labels.Selector) kubernetesNodes {
+	matched := kubernetesNodes{}
+	for name, node := range n {
+		if selector.Matches(node.Labels) {
+			matched[name] = node
+		}
+	}
+	return matched
+}
 
 func kubeClient(kubeConfigPath string) (*kubernetes.Clientset, error) {
 	config, err := clientcmd.BuildConfigFromFlags("", kubeConfigPath)
@@ -19,62 +42,174 @@ func kubeClient(kubeConfigPath string) (*kubernetes.Clientset, error) {
 	return kubernetes.NewForConfig(config)
 }
 
-// getAllKubernetesNodes loads the nodes in the target kubernetes cluster
-func getAllKubernetesNodes(client *kubernetes.Clientset) (kubernetesNodeIPs, error) {
-	nodes, err := client.CoreV1().Nodes().List(metav1.ListOptions{})
-	if err != nil {
-		return nil, err
+func nodeInternalIP(node *v1.Node) string {
+	ip := ""
+	for _, address := range node.Status.Addresses {
+		if address.Type == "InternalIP" {
+			ip = address.Address
+		}
 	}
-	nodeIPs := kubernetesNodeIPs{}
-	for _, node := range nodes.Items {
-		for _, address := range node.Status.Addresses {
-			if address.Type == "InternalIP" {
-				nodeIPs[node.Name] = address.Address
-			}
+	return ip
+}
+
+// named returns the nodes whose names are in names
+func (n kubernetesNodes) named(names map[string]bool) kubernetesNodes {
+	matched := kubernetesNodes{}
+	for name, node := range n {
+		if names[name] {
+			matched[name] = node
 		}
 	}
-	return nodeIPs, nil
+	return matched
 }
 
-func getProxiedKubernetesServices(client *kubernetes.Clientset) ([]v1.Service, error) {
+// getAllKubernetesNodes loads the nodes in the target kubernetes cluster that pass the filter
+func getAllKubernetesNodes(cache *kubernetesCache, filter NodeFilter) kubernetesNodes {
+	nodes := kubernetesNodes{}
+	for _, node := range cache.listNodes() {
+		if !filter.allows(node) {
+			continue
+		}
+		if ip := nodeInternalIP(node); ip != "" {
+			nodes[node.Name] = kubernetesNode{IP: ip, Labels: labels.Set(node.Labels)}
+		}
+	}
+	return nodes
+}
+
+// serviceProxied reports whether haproxy should be configured for the service
+func serviceProxied(service *v1.Service, options GeneratorOptions) bool {
+	if options.ManageLoadBalancers && service.Spec.Type == v1.ServiceTypeLoadBalancer {
+		return true
+	}
+	return service.Labels["haproxy-kubefigurator.enabled"] == "yes"
+}
+
+func getProxiedKubernetesServices(cache *kubernetesCache, options GeneratorOptions) []v1.Service {
 	proxiedServices := []v1.Service{}
-	services, err := client.CoreV1().Services(v1.NamespaceAll).List(metav1.ListOptions{})
-	if err != nil {
-		return nil, err
+	for _, service := range cache.listServices() {
+		if serviceProxied(service, options) {
+			proxiedServices = append(proxiedServices, *service)
+		}
 	}
-	for _, service := range services.Items {
-		if service.Labels["haproxy-kubefigurator.enabled"] == "yes" {
-			proxiedServices = append(proxiedServices, service)
+	return proxiedServices
+}
+
+// debouncedTrigger returns a function that requests a config update once changes have been quiet for a while
+func debouncedTrigger(ch chan<- bool) func() {
+	const quietTime = time.Second * 2
+	var mutex sync.Mutex
+	var timer *time.Timer
+	return func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if timer != nil {
+			timer.Stop()
 		}
+		timer = time.AfterFunc(quietTime, func() {
+			select {
+			case ch <- true: // if can't send, there is already a pending update.
+			default:
+				logger.Infof("Queue full. Already a pending config update.")
+			}
+		})
 	}
-	return proxiedServices, nil
 }
 
-func watchForServiceChanges(client *kubernetes.Clientset, ch chan<- bool) {
-	for {
-		start := time.Now()
-		logger.Debug("Watching for service changes")
-		w, err := client.CoreV1().Services("").Watch(metav1.ListOptions{})
-		if err != nil {
-			logger.Error(err)
-			time.Sleep(time.Second)
-			continue
+// watchForServiceChanges requests a config update whenever a service changes
+func watchForServiceChanges(cache *kubernetesCache, trigger func()) {
+	cache.services.onChange = func(eventType watch.EventType, old runtime.Object, obj runtime.Object) {
+		if service, ok := obj.(*v1.Service); ok {
+			logger.Infof("Detected change to service %s (%s)", service.Name, eventType)
 		}
-		var timer *time.Timer
-		const quietTime = time.Second * 2
-		for ev := range w.ResultChan() {
-			logger.Infof("Detected change to service %s (%s)", ev.Object.(*v1.Service).Name, ev.Type)
-			if timer != nil {
-				timer.Stop()
+		trigger()
+	}
+}
+
+// watchForNodeChanges requests a config update whenever a node joins, leaves or changes address or schedulability
+func watchForNodeChanges(cache *kubernetesCache, trigger func()) {
+	cache.nodes.onChange = func(eventType watch.EventType, old runtime.Object, obj runtime.Object) {
+		node, ok := obj.(*v1.Node)
+		if !ok {
+			return
+		}
+		if eventType == watch.Modified {
+			if oldNode, ok := old.(*v1.Node); ok && !nodeRoutingChanged(oldNode, node) {
+				return
 			}
-			timer = time.AfterFunc(quietTime, func() {
-				select {
-				case ch <- true: // if can't send, there is already a pending update.
-				default:
-					logger.Infof("Queue full. Already a pending config update.")
-				}
-			})
-		}
-		logger.Infof("Watch closed after %s", time.Now().Sub(start))
+		}
+		logger.Infof("Detected change to node %s (%s)", node.Name, eventType)
+		trigger()
+	}
+}
+
+// watchForEndpointsChanges requests a config update whenever the endpoints of a service whose backends depend on them change
+func watchForEndpointsChanges(cache *kubernetesCache, options GeneratorOptions, trigger func()) {
+	cache.endpoints.onChange = func(eventType watch.EventType, old runtime.Object, obj runtime.Object) {
+		endpoints, ok := obj.(*v1.Endpoints)
+		if !ok {
+			return
+		}
+		if oldEndpoints, ok := old.(*v1.Endpoints); ok && eventType == watch.Modified && reflect.DeepEqual(oldEndpoints.Subsets, endpoints.Subsets) {
+			return
+		}
+		service, exists := cache.getService(endpoints.Namespace, endpoints.Name)
+		if !exists || !serviceDependsOnEndpoints(serviceWrapper(*service), options) {
+			return
+		}
+		if !serviceProxied(service, options) && !serviceReferencedByIngress(cache, service, options) {
+			return
+		}
+		logger.Infof("Detected change to endpoints %s/%s (%s)", endpoints.Namespace, endpoints.Name, eventType)
+		trigger()
+	}
+}
+
+// watchForIngressChanges requests a config update whenever an ingress changes
+func watchForIngressChanges(cache *kubernetesCache, trigger func()) {
+	if cache.ingresses == nil {
+		return
+	}
+	cache.ingresses.onChange = func(eventType watch.EventType, old runtime.Object, obj runtime.Object) {
+		if ingress, ok := obj.(*extensionsv1beta1.Ingress); ok {
+			logger.Infof("Detected change to ingress %s/%s (%s)", ingress.Namespace, ingress.Name, eventType)
+		}
+		trigger()
+	}
+}
+
+// watchForSecretChanges requests a config update whenever a secret used by a service or ingress changes
+func watchForSecretChanges(cache *kubernetesCache, options GeneratorOptions, trigger func()) {
+	cache.secrets.onChange = func(eventType watch.EventType, old runtime.Object, obj runtime.Object) {
+		secret, ok := obj.(*v1.Secret)
+		if !ok {
+			return
+		}
+		if oldSecret, ok := old.(*v1.Secret); ok && eventType == watch.Modified && reflect.DeepEqual(oldSecret.Data, secret.Data) {
+			return
+		}
+		if !secretReferenced(cache, secret, options) {
+			return
+		}
+		logger.Infof("Detected change to secret %s/%s (%s)", secret.Namespace, secret.Name, eventType)
+		trigger()
+	}
+}
+
+// watchForConfigMapChanges requests a config update whenever a config map used by a service or ingress changes
+func watchForConfigMapChanges(cache *kubernetesCache, options GeneratorOptions, trigger func()) {
+	cache.configMaps.onChange = func(eventType watch.EventType, old runtime.Object, obj runtime.Object) {
+		configMap, ok := obj.(*v1.ConfigMap)
+		if !ok {
+			return
+		}
+		if oldConfigMap, ok := old.(*v1.ConfigMap); ok && eventType == watch.Modified && reflect.DeepEqual(oldConfigMap.Data, configMap.Data) {
+			return
+		}
+		if !annotationReferenced(cache, configMap.Namespace, configMap.Name, configMapAnnotations, options) {
+			return
+		}
+		logger.Infof("Detected change to config map %s/%s (%s)", configMap.Namespace, configMap.Name, eventType)
+		trigger()
 	}
 }
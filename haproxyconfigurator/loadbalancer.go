@@ -0,0 +1,109 @@
+package haproxyconfigurator
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// loadBalancerStatuses maps LoadBalancer services (namespace/name) to the addresses they are reachable on
+type loadBalancerStatuses map[string][]v1.LoadBalancerIngress
+
+func (s serviceWrapper) isLoadBalancer() bool {
+	return s.Spec.Type == v1.ServiceTypeLoadBalancer
+}
+
+// loadBalancerOnly reports whether the service is only proxied for being a managed LoadBalancer, not labelled
+func (s serviceWrapper) loadBalancerOnly(options GeneratorOptions) bool {
+	return options.ManageLoadBalancers && s.isLoadBalancer() && s.Labels["haproxy-kubefigurator.enabled"] != "yes"
+}
+
+func (s serviceWrapper) key() string {
+	return s.Namespace + "/" + s.Name
+}
+
+// expect records a managed LoadBalancer service so its status is cleared when none of its ports are configured
+func (l loadBalancerStatuses) expect(service serviceWrapper) {
+	if _, exists := l[service.key()]; !exists {
+		l[service.key()] = []v1.LoadBalancerIngress{}
+	}
+}
+
+// clearStale records the services that still carry a load balancer status without being LoadBalancers
+// anymore, so the status they were given is cleared
+func (l loadBalancerStatuses) clearStale(cache *kubernetesCache) {
+	for _, svc := range cache.listServices() {
+		service := serviceWrapper(*svc)
+		if !service.isLoadBalancer() && len(service.Status.LoadBalancer.Ingress) > 0 {
+			l[service.key()] = []v1.LoadBalancerIngress{}
+		}
+	}
+}
+
+// add records the addresses a configured port of the service listens on
+func (l loadBalancerStatuses) add(service serviceWrapper, listenIP string, hostname string, options GeneratorOptions) {
+	var addresses = []string{}
+	switch {
+	case listenIP != "*":
+		addresses = append(addresses, listenIP)
+	case hostname != "":
+		addresses = append(addresses, hostname)
+	default:
+		addresses = options.LoadBalancerAddresses
+	}
+
+	for _, address := range addresses {
+		ingress := v1.LoadBalancerIngress{Hostname: address}
+		if net.ParseIP(address) != nil {
+			ingress = v1.LoadBalancerIngress{IP: address}
+		}
+		var known = false
+		for _, existing := range l[service.key()] {
+			if existing == ingress {
+				known = true
+			}
+		}
+		if !known {
+			l[service.key()] = append(l[service.key()], ingress)
+		}
+	}
+}
+
+// updateLoadBalancerStatuses writes the addresses of LoadBalancer services back to their status
+func updateLoadBalancerStatuses(client *kubernetes.Clientset, cache *kubernetesCache, statuses loadBalancerStatuses) {
+	for key, ingress := range statuses {
+		obj, exists := cache.services.get(key)
+		if !exists {
+			continue
+		}
+		service, ok := obj.(*v1.Service)
+		if !ok {
+			continue
+		}
+		current := service.Status.LoadBalancer.Ingress
+		if len(current) == 0 && len(ingress) == 0 || reflect.DeepEqual(current, ingress) {
+			continue
+		}
+
+		patch := map[string]interface{}{
+			"status": map[string]interface{}{
+				"loadBalancer": map[string]interface{}{
+					"ingress": ingress,
+				},
+			},
+		}
+		data, err := json.Marshal(patch)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		logger.Infof("Updating load balancer status of service %s", key)
+		if _, err := client.CoreV1().Services(service.Namespace).Patch(service.Name, types.MergePatchType, data, "status"); err != nil {
+			logger.Error(err)
+		}
+	}
+}
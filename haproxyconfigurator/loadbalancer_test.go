@@ -0,0 +1,78 @@
+package haproxyconfigurator
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLoadBalancerStatusesAdd(t *testing.T) {
+	service := serviceWrapper(v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer}})
+	type port struct{ listenIP, hostname string }
+	for _, test := range []struct {
+		name      string
+		ports     []port
+		addresses []string
+		expected  []v1.LoadBalancerIngress
+	}{
+		{"listen-ip", []port{{"10.0.0.5", "www.example.com"}}, []string{"192.0.2.1"},
+			[]v1.LoadBalancerIngress{{IP: "10.0.0.5"}}},
+		{"hostname", []port{{"*", "www.example.com"}}, []string{"192.0.2.1"},
+			[]v1.LoadBalancerIngress{{Hostname: "www.example.com"}}},
+		{"load balancer addresses", []port{{"*", ""}}, []string{"192.0.2.1", "2001:db8::1", "lb.example.com"},
+			[]v1.LoadBalancerIngress{{IP: "192.0.2.1"}, {IP: "2001:db8::1"}, {Hostname: "lb.example.com"}}},
+		{"no load balancer addresses", []port{{"*", ""}}, nil,
+			[]v1.LoadBalancerIngress{}},
+		{"ports sharing an address", []port{{"*", "www.example.com"}, {"10.0.0.5", ""}, {"*", "www.example.com"}}, nil,
+			[]v1.LoadBalancerIngress{{Hostname: "www.example.com"}, {IP: "10.0.0.5"}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			statuses := loadBalancerStatuses{}
+			statuses.expect(service)
+			for _, p := range test.ports {
+				statuses.add(service, p.listenIP, p.hostname, GeneratorOptions{LoadBalancerAddresses: test.addresses})
+			}
+			expected := loadBalancerStatuses{"default/web": test.expected}
+			if !reflect.DeepEqual(statuses, expected) {
+				t.Errorf("expected %v, got %v", expected, statuses)
+			}
+		})
+	}
+}
+
+func TestLoadBalancerStatusesClearStale(t *testing.T) {
+	published := v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "192.0.2.1"}}}}
+	cache := newTestCache(t,
+		// No longer a LoadBalancer, but still carrying the status it was given
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "demoted"},
+			Spec: v1.ServiceSpec{Type: v1.ServiceTypeClusterIP}, Status: published},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "internal"},
+			Spec: v1.ServiceSpec{Type: v1.ServiceTypeClusterIP}},
+		// LoadBalancers are left to expect and add
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+			Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer}, Status: published},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unconfigured"},
+			Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer}, Status: published},
+	)
+	web, _ := cache.getService("default", "web")
+	unconfigured, _ := cache.getService("default", "unconfigured")
+
+	statuses := loadBalancerStatuses{}
+	statuses.expect(serviceWrapper(*web))
+	statuses.add(serviceWrapper(*web), "*", "", GeneratorOptions{LoadBalancerAddresses: []string{"192.0.2.1"}})
+	// None of its ports could be configured
+	statuses.expect(serviceWrapper(*unconfigured))
+	statuses.clearStale(cache)
+
+	expected := loadBalancerStatuses{
+		"default/demoted":      {},
+		"default/web":          {{IP: "192.0.2.1"}},
+		"default/unconfigured": {},
+	}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("expected %v, got %v", expected, statuses)
+	}
+}
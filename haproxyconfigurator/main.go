@@ -1,15 +1,17 @@
 package haproxyconfigurator
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	"strconv"
 	"strings"
+	"time"
 
-	"k8s.io/client-go/kubernetes"
-
+	"github.com/fatih/color"
 	"github.com/sirupsen/logrus"
 	"k8s.io/api/core/v1"
 )
@@ -23,76 +25,195 @@ func SetLogger(l *logrus.Logger) {
 	logger = l
 }
 
-func GenerateConfig(client *kubernetes.Clientset, clusterName string) (string, error) {
-	logger.Debug("Fetching Kubernetes Node Info")
-	nodes, err := getAllKubernetesNodes(client)
-	if err != nil {
-		return "", err
+// GeneratorOptions controls how configurations are generated from the cluster state
+type GeneratorOptions struct {
+	// ClusterName replaces the CLUSTER alias in hostnames
+	ClusterName string
+	NodeFilter  NodeFilter
+	// BackendTargets is the default for the backend-targets annotation
+	BackendTargets string
+	// ManageLoadBalancers configures every LoadBalancer service and writes its status back
+	ManageLoadBalancers bool
+	// LoadBalancerAddresses are reported for LoadBalancer services listening on all IPs without a hostname
+	LoadBalancerAddresses []string
+	// IngressClass enables generating frontends from ingresses of this class
+	IngressClass string
+	// TemplatePath is a text/template file used instead of the built-in renderer
+	TemplatePath string
+	// HaproxyVersion is the haproxy version the configuration must be valid for
+	HaproxyVersion string
+	// CertificateDir is where haproxy finds certificates, including the ones synced from secrets
+	CertificateDir string
+	// SSLDefaults is the TLS policy of hostnames without ssl-* annotations
+	SSLDefaults HaproxySSLOptions
+}
+
+// generatedConfig is the result of a configuration run
+type generatedConfig struct {
+	config string
+	// certificates are the files written to the certificate directory along with the config
+	certificates  certificateFiles
+	loadBalancers loadBalancerStatuses
+}
+
+// Validate checks the options for errors
+func (o GeneratorOptions) Validate() error {
+	if o.BackendTargets != "" && !validBackendTargets(o.BackendTargets) {
+		return errors.New("Invalid backend targets (" + o.BackendTargets + ") specified - valid options '" + backendTargetsNodePort + "', '" + backendTargetsEndpoints + "'")
 	}
-	logger.Debug("Fetching Kubernetes Service Info")
-	services, err := getProxiedKubernetesServices(client)
+	version, err := ParseHaproxyVersion(o.HaproxyVersion)
 	if err != nil {
-		return "", err
+		return err
 	}
-	logger.Debug("Generating New HAProxy Config")
-	config, err := buildHaproxyConfig(nodes, services, clusterName)
-	if err != nil {
-		return "", err
+	if messages := o.SSLDefaults.validate(version); len(messages) > 0 {
+		return errors.New(messages[0])
+	}
+	if !path.IsAbs(o.CertificateDir) {
+		return errors.New("Invalid certificate directory (" + o.CertificateDir + ") specified - it must be an absolute path")
+	}
+	if o.TemplatePath != "" {
+		if _, err := loadConfigTemplate(o.TemplatePath); err != nil {
+			return err
+		}
 	}
-	return config, nil
+	return o.NodeFilter.Validate()
+}
+
+// generateConfig builds a configuration from the cached cluster state
+func generateConfig(cache *kubernetesCache, options GeneratorOptions) (generatedConfig, error) {
+	logger.Debug("Generating New HAProxy Config")
+	return buildHaproxyConfig(cache, options)
 }
 
 // Run polls the kubernetes configuration and builds out load balancer configurations based on the services in kubernetes
-func Run(kubeconfigPath string, clusterName string, haproxyConfigPath string, watch bool, shouldPublish bool, command string) {
+func Run(kubeconfigPath string, options GeneratorOptions, haproxyConfigPath string, watch bool, shouldPublish bool, command string, etcdConfig EtcdConfig, resyncPeriod time.Duration) {
+	if err := options.Validate(); err != nil {
+		logger.Fatal(err)
+	}
 	client, err := kubeClient(kubeconfigPath)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
-	ch := make(chan bool, 1)
-	go func() {
-		if watch {
-			watchForServiceChanges(client, ch)
-		} else {
-			ch <- true
+	var target publisher
+	current := generatedConfig{}
+	if shouldPublish {
+		target, err = newPublisher(etcdConfig, haproxyConfigPath, command, options.CertificateDir)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		current, err = target.current()
+		if err != nil {
+			logger.Warn(err)
 		}
+	}
+
+	logger.Debug("Fetching Kubernetes Node and Service Info")
+	cache := newKubernetesCache(client, resyncPeriod, options)
+	if err := cache.sync(); err != nil {
+		logger.Fatal(err)
+	}
+
+	ch := make(chan bool, 1)
+	ch <- true
+	if watch {
+		trigger := debouncedTrigger(ch)
+		watchForServiceChanges(cache, trigger)
+		watchForNodeChanges(cache, trigger)
+		watchForEndpointsChanges(cache, options, trigger)
+		watchForIngressChanges(cache, trigger)
+		watchForSecretChanges(cache, options, trigger)
+		watchForConfigMapChanges(cache, options, trigger)
+		cache.run()
+	} else {
 		close(ch)
-	}()
-	currentConfig := ""
-	if shouldPublish {
-		dat, _ := ioutil.ReadFile(haproxyConfigPath)
-		currentConfig = string(dat)
 	}
 	for range ch {
-		config, err := GenerateConfig(client, clusterName)
+		generated, err := generateConfig(cache, options)
 		if err != nil {
 			logger.Error(err)
 			continue
 		}
-		changed := config != currentConfig
+		changed := generated.config != current.config || !generated.certificates.equal(current.certificates)
 		if changed {
-			logger.Info("Config changed!\n", config)
+			logger.Info("Config changed!\n", generated.config)
 			if shouldPublish {
-				publish(config, haproxyConfigPath, command)
+				if err := target.publish(generated); err != nil {
+					logger.Error(err)
+					continue
+				}
 			}
-			currentConfig = config
+			current = generated
 		} else {
 			logger.Debug("No change to config")
 		}
+		// Only report addresses once load balancers have been handed the configuration
+		if shouldPublish {
+			updateLoadBalancerStatuses(client, cache, generated.loadBalancers)
+		}
+	}
+}
+
+// publisher stores a generated configuration and its certificates where load balancers can consume them
+type publisher interface {
+	current() (generatedConfig, error)
+	publish(generated generatedConfig) error
+}
+
+func newPublisher(etcdConfig EtcdConfig, haproxyConfigPath string, command string, certificateDir string) (publisher, error) {
+	if etcdConfig.Enabled() {
+		return newEtcdPublisher(etcdConfig)
 	}
+	return &filePublisher{path: haproxyConfigPath, command: command, certificateDir: certificateDir}, nil
+}
+
+// filePublisher writes the configuration and certificates to local files and executes a command afterwards
+type filePublisher struct {
+	path           string
+	command        string
+	certificateDir string
 }
 
-func publish(config string, haproxyConfigPath string, command string) {
-	ioutil.WriteFile(haproxyConfigPath, []byte(config), 0644)
+func (f *filePublisher) current() (generatedConfig, error) {
+	certificates, err := readManagedFiles(f.certificateDir)
+	if err != nil {
+		return generatedConfig{}, err
+	}
+	dat, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return generatedConfig{certificates: certificates}, nil
+	}
+	return generatedConfig{config: string(dat), certificates: certificates}, err
+}
+
+func (f *filePublisher) publish(generated generatedConfig) error {
+	// Certificates must be in place before the configuration referencing them
+	if err := writeManagedFiles(f.certificateDir, generated.certificates); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(f.path, []byte(generated.config), 0644); err != nil {
+		return err
+	}
+	if err := removeOrphanedFiles(f.certificateDir, generated.certificates); err != nil {
+		logger.Warn(err)
+	}
+	return runCommand(f.command)
+}
+
+func runCommand(command string) error {
+	if command == "" {
+		return nil
+	}
 	parts := strings.Split(command, " ")
 	logger.Infof("Executing '%s'", command)
 	cmd := exec.Command(parts[0], parts[1:]...)
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
 	if err := cmd.Run(); err != nil {
-		logger.Error(err)
+		return err
 	}
 	logger.Info("Done executing command")
+	return nil
 }
 
 type servicePortWrapper v1.ServicePort
@@ -103,6 +224,11 @@ func (s servicePortWrapper) annoName(name string) string {
 
 type serviceWrapper v1.Service
 
+// portLabel identifies a service port in messages
+func (s serviceWrapper) portLabel(p servicePortWrapper) string {
+	return s.Namespace + "/" + s.Name + ":" + p.Name
+}
+
 func (s serviceWrapper) anno(p servicePortWrapper, name string) string {
 	return s.Annotations[p.annoName(name)]
 }
@@ -111,36 +237,111 @@ func (s serviceWrapper) annoExists(p servicePortWrapper, name string) (string, b
 	return str, ok
 }
 
-func buildHaproxyConfig(nodes map[string]string, services []v1.Service, clusterName string) (string, error) {
+// reportInvalidService prints why a service could not be configured
+func reportInvalidService(name string, messages []string) {
+	color.Red(name)
+	for _, message := range messages {
+		color.Red("  " + message)
+	}
+}
+
+// listenerName names the frontend for an IP and port
+func listenerName(listenIP string, listenPort uint16) string {
+	var ipLabel = listenIP
+	if listenIP == "*" {
+		ipLabel = "all"
+	}
+	return "k8s-service_" + ipLabel + "_" + strconv.Itoa(int(listenPort)) + "_listen"
+}
+
+// annotationList splits a comma separated annotation, dropping empty entries
+func annotationList(value string) []string {
+	var list = []string{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// parseHSTSMaxAge parses the hsts-max-age annotation, in seconds
+func parseHSTSMaxAge(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	maxAge, err := strconv.Atoi(value)
+	if err != nil || maxAge < 1 {
+		return 0, errors.New("Invalid hsts-max-age (" + value + ") specified - expected a positive number of seconds")
+	}
+	return maxAge, nil
+}
+
+func buildHaproxyConfig(cache *kubernetesCache, options GeneratorOptions) (generatedConfig, error) {
 	var configurator = HaproxyConfigurator{}
 	configurator.Initialize()
+	version, err := ParseHaproxyVersion(options.HaproxyVersion)
+	if err != nil {
+		return generatedConfig{}, err
+	}
+	configurator.Version = version
+	configurator.CertificateDir = options.CertificateDir
+	configurator.SSLDefaults = options.SSLDefaults
+	var loadBalancers = loadBalancerStatuses{}
+	var certificates = certificateFiles{}
+
+	if options.ManageLoadBalancers {
+		loadBalancers.clearStale(cache)
+	}
 
-	for _, svc := range services {
+	nodes := getAllKubernetesNodes(cache, options.NodeFilter)
+	for _, svc := range getProxiedKubernetesServices(cache, options) {
 		service := serviceWrapper(svc)
+		if options.ManageLoadBalancers && service.isLoadBalancer() {
+			loadBalancers.expect(service)
+		}
 		for _, p := range service.Spec.Ports {
 			port := servicePortWrapper(p)
-			if port.NodePort == 0 {
+			// Only NodePorts can be reached without routing to the pod network
+			if port.NodePort == 0 && service.backendTargetsMode(port, options) != backendTargetsEndpoints {
 				continue
 			}
 
-			serviceHostname := strings.Replace(service.anno(port, "hostname"), "CLUSTER", clusterName, 1)
+			serviceHostname := strings.Replace(service.anno(port, "hostname"), "CLUSTER", options.ClusterName, 1)
+
+			targets, err := serviceBackendTargets(cache, nodes, service, port, options)
+			if err != nil {
+				reportInvalidService(service.portLabel(port), []string{err.Error()})
+				continue
+			}
+
+			healthCheck, err := serviceHealthCheck(service, port, options, func(name string) string { return service.anno(port, name) })
+			if err != nil {
+				reportInvalidService(service.portLabel(port), []string{err.Error()})
+				continue
+			}
 
-			var targets = []HaproxyBackendTarget{}
-			for hostname, ip := range nodes {
-				targets = append(targets, HaproxyBackendTarget{
-					Name: hostname,
-					IP:   ip,
-					Port: port.NodePort,
-				})
+			// Services only proxied for being LoadBalancers get what other load balancer implementations
+			// give them: their own ports, passed through as TCP
+			var loadBalancerOnly = service.loadBalancerOnly(options)
+			if port.Protocol != "" && port.Protocol != v1.ProtocolTCP {
+				reportInvalidService(service.portLabel(port), []string{"Only TCP ports can be proxied (protocol " + string(port.Protocol) + ")"})
+				continue
 			}
 
 			var haproxyListenPort = uint16(443)
+			if loadBalancerOnly {
+				haproxyListenPort = uint16(port.Port)
+			}
 			if lp := service.anno(port, "listen-port"); lp != "" {
 				var listenPort, _ = strconv.Atoi(lp)
 				haproxyListenPort = uint16(listenPort)
 			}
 
 			var haproxyMode = "http"
+			if loadBalancerOnly {
+				haproxyMode = "tcp"
+			}
 			if mode := service.anno(port, "haproxy-mode"); mode != "" {
 				haproxyMode = mode
 			}
@@ -148,18 +349,44 @@ func buildHaproxyConfig(nodes map[string]string, services []v1.Service, clusterN
 			var listenIP = "*"
 			if lIP := service.anno(port, "listen-ip"); lIP != "" {
 				listenIP = lIP
+			} else if service.isLoadBalancer() && service.Spec.LoadBalancerIP != "" {
+				listenIP = service.Spec.LoadBalancerIP
 			}
 
 			// Default the service to use SSL with <hostname>.pem
-			// SSL is enabled by default for HTTP
+			// SSL is enabled by default for HTTP services with a certificate
+			// A certificate synced from a secret takes precedence over files provisioned on the load balancers
 			var sslCertificate = ""
+			var serviceCertificates = certificateFiles{}
+			var hasCertificate = serviceHostname != "" || service.anno(port, "tls-secret") != "" || service.anno(port, "ssl-certificate") != ""
 			useSSL, exists := service.annoExists(port, "use-ssl")
-			if (haproxyMode == "http" && !exists) || useSSL == "true" {
-				if cert := service.anno(port, "ssl-certificate"); cert != "" {
-					sslCertificate = "/etc/haproxy/ssl/" + cert
+			if (haproxyMode == "http" && !exists && hasCertificate) || useSSL == "true" {
+				if !hasCertificate {
+					reportInvalidService(service.portLabel(port), []string{"use-ssl requires a hostname, tls-secret or ssl-certificate"})
+					continue
+				}
+				if secretName := service.anno(port, "tls-secret"); secretName != "" {
+					fileName, err := secretCertificate(cache, serviceCertificates, service.Namespace, secretName)
+					if err != nil {
+						reportInvalidService(service.portLabel(port), []string{err.Error()})
+						continue
+					}
+					sslCertificate = certificatePath(options, fileName)
 				} else {
-					sslCertificate = "/etc/haproxy/ssl/" + serviceHostname + ".pem"
+					var fileName = serviceHostname + ".pem"
+					if cert := service.anno(port, "ssl-certificate"); cert != "" {
+						fileName = cert
+					}
+					var err error
+					sslCertificate, err = provisionedCertificate(options, fileName)
+					if err != nil {
+						reportInvalidService(service.portLabel(port), []string{err.Error()})
+						continue
+					}
 				}
+			} else if service.anno(port, "tls-secret") != "" {
+				reportInvalidService(service.portLabel(port), []string{"tls-secret requires use-ssl"})
+				continue
 			}
 
 			// Default backends to use SSL if SSL is used on the front-end
@@ -193,30 +420,118 @@ func buildHaproxyConfig(nodes map[string]string, services []v1.Service, clusterN
 				backendBalanceMethod = backendBalanceMethodLabel
 			}
 
-			var ipLabel = listenIP
-			if listenIP == "*" {
-				ipLabel = "all"
+			var redirectHTTPListener = ""
+			if service.anno(port, "redirect-http") == "true" {
+				redirectHTTPListener = listenerName(listenIP, httpRedirectPort)
 			}
 
-			configurator.AddListener(
+			hstsMaxAge, err := parseHSTSMaxAge(service.anno(port, "hsts-max-age"))
+			if err != nil {
+				reportInvalidService(service.portLabel(port), []string{err.Error()})
+				continue
+			}
+
+			timeouts, err := parseTimeouts(func(name string) string { return service.anno(port, name) })
+			if err != nil {
+				reportInvalidService(service.portLabel(port), []string{err.Error()})
+				continue
+			}
+
+			maxConn, err := parseMaxConn(service.anno(port, "backends-maxconn"))
+			if err != nil {
+				reportInvalidService(service.portLabel(port), []string{err.Error()})
+				continue
+			}
+
+			stickiness, err := serviceStickiness(service, func(name string) string { return service.anno(port, name) })
+			if err != nil {
+				reportInvalidService(service.portLabel(port), []string{err.Error()})
+				continue
+			}
+
+			auth, err := basicAuth(cache, service.Namespace, func(name string) string { return service.anno(port, name) })
+			if err != nil {
+				reportInvalidService(service.portLabel(port), []string{err.Error()})
+				continue
+			}
+
+			var sslOptions = parseSSLOptions(func(name string) string { return service.anno(port, name) })
+			sslOptions.Verify, sslOptions.CAFile, err = clientVerification(cache, serviceCertificates, options, service.Namespace, func(name string) string { return service.anno(port, name) })
+			if err != nil {
+				reportInvalidService(service.portLabel(port), []string{err.Error()})
+				continue
+			}
+
+			added := configurator.AddListener(
 				HaproxyListenerConfig{
-					Name:           "k8s-service_" + ipLabel + "_" + strconv.Itoa(int(haproxyListenPort)) + "_listen",
-					ListenIP:       listenIP,
-					ListenPort:     haproxyListenPort,
-					Mode:           haproxyMode,
-					Hostname:       serviceHostname,
-					SslCertificate: sslCertificate,
+					Name:                 listenerName(listenIP, haproxyListenPort),
+					ListenIP:             listenIP,
+					ListenPort:           haproxyListenPort,
+					Mode:                 haproxyMode,
+					Hostname:             serviceHostname,
+					PathPrefix:           service.anno(port, "path-prefix"),
+					PathRegex:            service.anno(port, "path-regex"),
+					SslCertificate:       sslCertificate,
+					SslOptions:           sslOptions,
+					ClientDNHeader:       service.anno(port, "client-dn-header"),
+					SNIPassthrough:       service.anno(port, "ssl-passthrough") == "true",
+					AllowCIDRs:           annotationList(service.anno(port, "allow-cidrs")),
+					DenyCIDRs:            annotationList(service.anno(port, "deny-cidrs")),
+					BasicAuth:            auth,
+					RedirectHTTPListener: redirectHTTPListener,
 					Backend: HaproxyBackend{
 						Name:          "k8s-service_" + service.Namespace + "_" + service.Name + "_" + port.Name + "_backend",
 						Backends:      targets,
 						BalanceMethod: backendBalanceMethod,
 						UseSSL:        backendsUseSSL,
 						VerifySSL:     backendsVerifySSL,
+						HealthCheck:   healthCheck,
+						Timeouts:      timeouts,
+						Stickiness:    stickiness,
+						MaxConn:       maxConn,
+						HSTSMaxAge:    hstsMaxAge,
+						Source: HaproxyBackendSource{
+							Kind:        "Service",
+							Namespace:   service.Namespace,
+							Name:        service.Name,
+							Port:        port.Name,
+							Labels:      service.Labels,
+							Annotations: service.Annotations,
+						},
 					},
 				},
 			)
+			if added {
+				for name, data := range serviceCertificates {
+					certificates[name] = data
+				}
+			}
+			if added && options.ManageLoadBalancers && service.isLoadBalancer() {
+				loadBalancers.add(service, listenIP, serviceHostname, options)
+			}
 		}
 	}
 
-	return configurator.Render(), nil
+	addIngressListeners(&configurator, cache, nodes, certificates, options)
+
+	tmpl, err := parseConfigTemplate("default", DefaultTemplate)
+	if options.TemplatePath != "" {
+		tmpl, err = loadConfigTemplate(options.TemplatePath)
+	}
+	if err != nil {
+		return generatedConfig{}, err
+	}
+	config, err := configurator.RenderTemplate(tmpl)
+	if err != nil {
+		return generatedConfig{}, err
+	}
+	for name, data := range configurator.CertificateFiles() {
+		certificates[name] = data
+	}
+
+	return generatedConfig{
+		config:        config,
+		certificates:  certificates,
+		loadBalancers: loadBalancers,
+	}, nil
 }
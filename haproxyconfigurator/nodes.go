@@ -0,0 +1,134 @@
+package haproxyconfigurator
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// NodeFilter decides which nodes can be used as backend targets
+type NodeFilter struct {
+	// IncludeNotReady keeps nodes whose Ready condition is not True, along with their not-ready and
+	// unreachable taints
+	IncludeNotReady bool
+	// ExcludeCordoned drops nodes marked unschedulable
+	ExcludeCordoned bool
+	// ExcludeTaints drops nodes carrying a matching taint, written as key[=value][:effect] or :effect
+	ExcludeTaints []string
+	// Selector is a label selector nodes must match
+	Selector string
+}
+
+// notReadyTaints are the taints the node controller adds to nodes that are not Ready; IncludeNotReady
+// keeps their nodes unless a selector names the taint key
+var notReadyTaints = []string{"node.kubernetes.io/not-ready", "node.kubernetes.io/unreachable"}
+
+type taintSelector struct {
+	key      string
+	value    string
+	hasValue bool
+	effect   v1.TaintEffect
+}
+
+func parseTaintSelector(selector string) (taintSelector, error) {
+	var parsed taintSelector
+	rest := selector
+	if i := strings.LastIndex(rest, ":"); i >= 0 {
+		parsed.effect = v1.TaintEffect(rest[i+1:])
+		rest = rest[:i]
+		switch parsed.effect {
+		case v1.TaintEffectNoSchedule, v1.TaintEffectPreferNoSchedule, v1.TaintEffectNoExecute:
+		default:
+			return parsed, errors.New("Invalid taint effect in '" + selector + "' - valid options 'NoSchedule', 'PreferNoSchedule', 'NoExecute'")
+		}
+	}
+	if i := strings.Index(rest, "="); i >= 0 {
+		parsed.value = rest[i+1:]
+		parsed.hasValue = true
+		rest = rest[:i]
+	}
+	parsed.key = rest
+	if parsed.key == "" && parsed.effect == "" {
+		return parsed, errors.New("Invalid taint '" + selector + "' - a key or an effect is required")
+	}
+	return parsed, nil
+}
+
+func (t taintSelector) matches(taint v1.Taint) bool {
+	if t.key != "" && t.key != taint.Key {
+		return false
+	}
+	if t.hasValue && t.value != taint.Value {
+		return false
+	}
+	if t.effect != "" && t.effect != taint.Effect {
+		return false
+	}
+	return true
+}
+
+// Validate checks the label and taint selectors of the filter
+func (f NodeFilter) Validate() error {
+	if _, err := labels.Parse(f.Selector); err != nil {
+		return err
+	}
+	for _, selector := range f.ExcludeTaints {
+		if _, err := parseTaintSelector(selector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nodeReady(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// allows reports whether the node may receive traffic
+func (f NodeFilter) allows(node *v1.Node) bool {
+	if !f.IncludeNotReady && !nodeReady(node) {
+		logger.Debugf("Skipping node %s: not ready", node.Name)
+		return false
+	}
+	if selector, err := labels.Parse(f.Selector); err == nil && !selector.Matches(labels.Set(node.Labels)) {
+		logger.Debugf("Skipping node %s: does not match selector %s", node.Name, f.Selector)
+		return false
+	}
+	if f.ExcludeCordoned && node.Spec.Unschedulable {
+		logger.Debugf("Skipping node %s: cordoned", node.Name)
+		return false
+	}
+	for _, s := range f.ExcludeTaints {
+		selector, err := parseTaintSelector(s)
+		if err != nil {
+			continue
+		}
+		for _, taint := range node.Spec.Taints {
+			if f.IncludeNotReady && selector.key == "" && contains(notReadyTaints, taint.Key) {
+				continue
+			}
+			if selector.matches(taint) {
+				logger.Debugf("Skipping node %s: tainted with %s", node.Name, taint.ToString())
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// nodeRoutingChanged reports whether a node update can affect the generated backends
+func nodeRoutingChanged(old *v1.Node, node *v1.Node) bool {
+	return nodeInternalIP(old) != nodeInternalIP(node) ||
+		nodeReady(old) != nodeReady(node) ||
+		old.Spec.Unschedulable != node.Spec.Unschedulable ||
+		!reflect.DeepEqual(old.Labels, node.Labels) ||
+		!reflect.DeepEqual(old.Spec.Taints, node.Spec.Taints)
+}
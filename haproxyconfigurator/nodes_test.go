@@ -0,0 +1,91 @@
+package haproxyconfigurator
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestParseTaintSelector(t *testing.T) {
+	for _, test := range []struct {
+		selector string
+		expected taintSelector
+		invalid  bool
+	}{
+		{"dedicated", taintSelector{key: "dedicated"}, false},
+		{"dedicated=haproxy", taintSelector{key: "dedicated", value: "haproxy", hasValue: true}, false},
+		{"dedicated=", taintSelector{key: "dedicated", hasValue: true}, false},
+		{"dedicated=haproxy:NoSchedule", taintSelector{key: "dedicated", value: "haproxy", hasValue: true, effect: v1.TaintEffectNoSchedule}, false},
+		{"dedicated:PreferNoSchedule", taintSelector{key: "dedicated", effect: v1.TaintEffectPreferNoSchedule}, false},
+		{":NoExecute", taintSelector{effect: v1.TaintEffectNoExecute}, false},
+		{"dedicated:NoRun", taintSelector{}, true},
+		{"", taintSelector{}, true},
+		{"=haproxy", taintSelector{}, true},
+	} {
+		t.Run(test.selector, func(t *testing.T) {
+			selector, err := parseTaintSelector(test.selector)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", selector)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if selector != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, selector)
+			}
+		})
+	}
+}
+
+func TestTaintSelectorMatches(t *testing.T) {
+	taint := v1.Taint{Key: "dedicated", Value: "haproxy", Effect: v1.TaintEffectNoSchedule}
+	for _, test := range []struct {
+		selector string
+		matches  bool
+	}{
+		{"dedicated", true},
+		{"dedicated=haproxy", true},
+		{"dedicated=other", false},
+		{"dedicated=", false},
+		{"dedicated:NoSchedule", true},
+		{"dedicated:NoExecute", false},
+		{":NoSchedule", true},
+		{"other", false},
+	} {
+		selector, err := parseTaintSelector(test.selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if selector.matches(taint) != test.matches {
+			t.Errorf("%s: expected match %v", test.selector, test.matches)
+		}
+	}
+}
+
+func TestNodeFilterNotReadyTaints(t *testing.T) {
+	unreachable := &v1.Node{Spec: v1.NodeSpec{Taints: []v1.Taint{
+		{Key: "node.kubernetes.io/unreachable", Effect: v1.TaintEffectNoExecute},
+	}}}
+	drained := &v1.Node{Spec: v1.NodeSpec{Taints: []v1.Taint{
+		{Key: "node.kubernetes.io/unreachable", Effect: v1.TaintEffectNoExecute},
+		{Key: "maintenance", Effect: v1.TaintEffectNoExecute},
+	}}}
+	for _, test := range []struct {
+		name    string
+		filter  NodeFilter
+		node    *v1.Node
+		allowed bool
+	}{
+		{"not ready", NodeFilter{ExcludeTaints: []string{":NoExecute"}}, unreachable, false},
+		{"included", NodeFilter{IncludeNotReady: true, ExcludeTaints: []string{":NoExecute"}}, unreachable, true},
+		{"taint named", NodeFilter{IncludeNotReady: true, ExcludeTaints: []string{"node.kubernetes.io/unreachable"}}, unreachable, false},
+		{"other taint", NodeFilter{IncludeNotReady: true, ExcludeTaints: []string{":NoExecute"}}, drained, false},
+	} {
+		if allowed := test.filter.allows(test.node); allowed != test.allowed {
+			t.Errorf("%s: expected allowed %v, got %v", test.name, test.allowed, allowed)
+		}
+	}
+}
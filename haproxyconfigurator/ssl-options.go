@@ -0,0 +1,94 @@
+package haproxyconfigurator
+
+import (
+	"regexp"
+	"strings"
+)
+
+// sslVersions are the TLS versions ssl-min-ver accepts
+var sslVersions = []string{"SSLv3", "TLSv1.0", "TLSv1.1", "TLSv1.2", "TLSv1.3"}
+
+var alpnPattern = regexp.MustCompile(`^[A-Za-z0-9./-]+(,[A-Za-z0-9./-]+)*$`)
+
+// cipherListPattern matches OpenSSL cipher lists like "ECDHE+AESGCM:!aNULL"
+var cipherListPattern = regexp.MustCompile(`^[A-Za-z0-9_.+!@=-]+(:[A-Za-z0-9_.+!@=-]+)*$`)
+
+// cipherSuitesPattern matches TLSv1.3 cipher suite lists like "TLS_AES_128_GCM_SHA256:TLS_AES_256_GCM_SHA384"
+var cipherSuitesPattern = regexp.MustCompile(`^TLS_[A-Z0-9_]+(:TLS_[A-Z0-9_]+)*$`)
+
+// parseSSLOptions reads the ssl-* annotations of a service port or ingress
+func parseSSLOptions(anno func(name string) string) HaproxySSLOptions {
+	return HaproxySSLOptions{
+		ALPN:         anno("ssl-alpn"),
+		MinVersion:   anno("ssl-min-ver"),
+		Ciphers:      anno("ssl-ciphers"),
+		Ciphersuites: anno("ssl-ciphersuites"),
+	}
+}
+
+// validate returns a message for every option haproxy of the version would reject
+func (o HaproxySSLOptions) validate(version HaproxyVersion) []string {
+	var messages = []string{}
+	if o.MinVersion != "" && !contains(sslVersions, o.MinVersion) {
+		messages = append(messages, "Invalid ssl-min-ver ("+o.MinVersion+") specified - valid options '"+strings.Join(sslVersions, "', '")+"'")
+	}
+	if o.ALPN != "" && !alpnPattern.MatchString(o.ALPN) {
+		messages = append(messages, "Invalid ssl-alpn ("+o.ALPN+") specified - expected comma separated protocols like 'h2,http/1.1'")
+	}
+	if o.Ciphers != "" && !cipherListPattern.MatchString(o.Ciphers) {
+		messages = append(messages, "Invalid ssl-ciphers ("+o.Ciphers+") specified - expected an OpenSSL cipher list like 'ECDHE+AESGCM:!aNULL'")
+	}
+	if o.Ciphersuites != "" {
+		if !cipherSuitesPattern.MatchString(o.Ciphersuites) {
+			messages = append(messages, "Invalid ssl-ciphersuites ("+o.Ciphersuites+") specified - expected TLSv1.3 cipher suites like 'TLS_AES_128_GCM_SHA256:TLS_AES_256_GCM_SHA384'")
+		}
+		if !version.supports(featureCiphersuites) {
+			messages = append(messages, "ssl-ciphersuites requires haproxy 1.9 or newer (targeting "+version.String()+")")
+		}
+	}
+	if o.Verify != "" && !contains([]string{"none", "optional", "required"}, o.Verify) {
+		messages = append(messages, "Invalid client certificate verification ("+o.Verify+") specified - valid options 'none', 'optional', 'required'")
+	}
+	if (o.Verify == "optional" || o.Verify == "required") && o.CAFile == "" {
+		messages = append(messages, "Client certificate verification ("+o.Verify+") requires a CA file")
+	}
+	return messages
+}
+
+// withDefaults returns the options with every empty value taken from defaults
+func (o HaproxySSLOptions) withDefaults(defaults HaproxySSLOptions) HaproxySSLOptions {
+	for _, option := range []struct {
+		value    *string
+		fallback string
+	}{
+		{&o.ALPN, defaults.ALPN},
+		{&o.MinVersion, defaults.MinVersion},
+		{&o.Ciphers, defaults.Ciphers},
+		{&o.Ciphersuites, defaults.Ciphersuites},
+		{&o.Verify, defaults.Verify},
+		{&o.CAFile, defaults.CAFile},
+	} {
+		if *option.value == "" {
+			*option.value = option.fallback
+		}
+	}
+	return o
+}
+
+// arguments renders the options as bind or crt-list arguments, leaving out empty ones
+func (o HaproxySSLOptions) arguments() []string {
+	var arguments = []string{}
+	for _, option := range []struct{ name, value string }{
+		{"alpn", o.ALPN},
+		{"ssl-min-ver", o.MinVersion},
+		{"ciphers", o.Ciphers},
+		{"ciphersuites", o.Ciphersuites},
+		{"verify", o.Verify},
+		{"ca-file", o.CAFile},
+	} {
+		if option.value != "" {
+			arguments = append(arguments, option.name, option.value)
+		}
+	}
+	return arguments
+}
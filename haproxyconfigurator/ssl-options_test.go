@@ -0,0 +1,39 @@
+package haproxyconfigurator
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSSLOptionsValidate(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		options HaproxySSLOptions
+		version HaproxyVersion
+		valid   bool
+	}{
+		{"none", HaproxySSLOptions{}, HaproxyVersion{1, 8}, true},
+		{"policy", HaproxySSLOptions{ALPN: "h2,http/1.1", MinVersion: "TLSv1.2", Ciphers: "ECDHE+AESGCM:!aNULL"}, HaproxyVersion{1, 8}, true},
+		{"ciphersuites", HaproxySSLOptions{Ciphersuites: "TLS_AES_128_GCM_SHA256:TLS_AES_256_GCM_SHA384"}, HaproxyVersion{1, 9}, true},
+		{"ciphersuites before 1.9", HaproxySSLOptions{Ciphersuites: "TLS_AES_128_GCM_SHA256"}, HaproxyVersion{1, 8}, false},
+		{"unknown version", HaproxySSLOptions{MinVersion: "TLSv1.4"}, HaproxyVersion{2, 0}, false},
+		{"alpn with spaces", HaproxySSLOptions{ALPN: "h2, http/1.1"}, HaproxyVersion{2, 0}, false},
+		{"ciphers with spaces", HaproxySSLOptions{Ciphers: "ECDHE AESGCM"}, HaproxyVersion{2, 0}, false},
+		{"cipher list as suites", HaproxySSLOptions{Ciphersuites: "ECDHE+AESGCM"}, HaproxyVersion{2, 0}, false},
+		{"verify", HaproxySSLOptions{Verify: "always"}, HaproxyVersion{2, 0}, false},
+	} {
+		if messages := test.options.validate(test.version); (len(messages) == 0) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, messages)
+		}
+	}
+}
+
+func TestSSLOptionsWithDefaults(t *testing.T) {
+	options := HaproxySSLOptions{ALPN: "http/1.1"}.withDefaults(HaproxySSLOptions{ALPN: "h2,http/1.1", MinVersion: "TLSv1.2"})
+	if expected := (HaproxySSLOptions{ALPN: "http/1.1", MinVersion: "TLSv1.2"}); options != expected {
+		t.Errorf("expected %+v, got %+v", expected, options)
+	}
+	if arguments, expected := options.arguments(), []string{"alpn", "http/1.1", "ssl-min-ver", "TLSv1.2"}; !reflect.DeepEqual(arguments, expected) {
+		t.Errorf("expected %v, got %v", expected, arguments)
+	}
+}
@@ -0,0 +1,65 @@
+package haproxyconfigurator
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// sessionAffinityNone balances every request
+	sessionAffinityNone = "none"
+	// sessionAffinityCookie inserts a cookie naming the server that answered the first request
+	sessionAffinityCookie = "cookie"
+	// sessionAffinitySource remembers the server of each client IP in a stick table
+	sessionAffinitySource = "source"
+)
+
+// defaultSessionAffinityCookie is the cookie name used when session-affinity-cookie is not set
+const defaultSessionAffinityCookie = "SERVERID"
+
+// defaultSessionAffinityTimeout matches the default ClientIP timeout of kubernetes services
+const defaultSessionAffinityTimeout = "3h"
+
+var cookieNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// serviceStickiness returns how clients stick to a backend server, from the session-affinity
+// annotations read through anno or else the service's own sessionAffinity
+func serviceStickiness(service serviceWrapper, anno func(name string) string) (HaproxyStickiness, error) {
+	var stickiness = HaproxyStickiness{Mode: anno("session-affinity")}
+	if stickiness.Mode == "" {
+		stickiness.Mode = sessionAffinityNone
+		if service.Spec.SessionAffinity == v1.ServiceAffinityClientIP {
+			stickiness.Mode = sessionAffinitySource
+		}
+	}
+
+	switch stickiness.Mode {
+	case sessionAffinityNone:
+		return HaproxyStickiness{}, nil
+	case sessionAffinityCookie:
+		stickiness.CookieName = defaultSessionAffinityCookie
+		if name := anno("session-affinity-cookie"); name != "" {
+			if !cookieNamePattern.MatchString(name) {
+				return stickiness, errors.New("Invalid session-affinity-cookie (" + name + ") specified - only letters, digits, '-' and '_' are allowed")
+			}
+			stickiness.CookieName = name
+		}
+	case sessionAffinitySource:
+		stickiness.Expire = defaultSessionAffinityTimeout
+		if config := service.Spec.SessionAffinityConfig; config != nil && config.ClientIP != nil && config.ClientIP.TimeoutSeconds != nil {
+			stickiness.Expire = strconv.Itoa(int(*config.ClientIP.TimeoutSeconds)) + "s"
+		}
+		if timeout := anno("session-affinity-timeout"); timeout != "" {
+			if err := validateHaproxyTime("session-affinity-timeout", timeout); err != nil {
+				return stickiness, err
+			}
+			stickiness.Expire = timeout
+		}
+	default:
+		return stickiness, errors.New("Invalid session-affinity (" + stickiness.Mode + ") specified - valid options '" + sessionAffinityNone + "', '" + sessionAffinityCookie + "', '" + sessionAffinitySource + "'")
+	}
+	return stickiness, nil
+}
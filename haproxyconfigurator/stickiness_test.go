@@ -0,0 +1,54 @@
+package haproxyconfigurator
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestServiceStickiness(t *testing.T) {
+	timeout := int32(600)
+	clientIP := v1.ServiceSpec{SessionAffinity: v1.ServiceAffinityClientIP,
+		SessionAffinityConfig: &v1.SessionAffinityConfig{ClientIP: &v1.ClientIPConfig{TimeoutSeconds: &timeout}}}
+	for _, test := range []struct {
+		name        string
+		spec        v1.ServiceSpec
+		annotations map[string]string
+		expected    HaproxyStickiness
+		invalid     bool
+	}{
+		{"none", v1.ServiceSpec{}, nil, HaproxyStickiness{}, false},
+		{"explicitly none", clientIP, map[string]string{"session-affinity": "none"}, HaproxyStickiness{}, false},
+		{"cookie", v1.ServiceSpec{}, map[string]string{"session-affinity": "cookie"},
+			HaproxyStickiness{Mode: "cookie", CookieName: "SERVERID"}, false},
+		{"cookie name", v1.ServiceSpec{}, map[string]string{"session-affinity": "cookie", "session-affinity-cookie": "APP_server-1"},
+			HaproxyStickiness{Mode: "cookie", CookieName: "APP_server-1"}, false},
+		{"invalid cookie name", v1.ServiceSpec{}, map[string]string{"session-affinity": "cookie", "session-affinity-cookie": "APP;SERVER"},
+			HaproxyStickiness{}, true},
+		{"source", v1.ServiceSpec{}, map[string]string{"session-affinity": "source"},
+			HaproxyStickiness{Mode: "source", Expire: "3h"}, false},
+		{"ClientIP session affinity", clientIP, nil, HaproxyStickiness{Mode: "source", Expire: "600s"}, false},
+		{"source timeout", clientIP, map[string]string{"session-affinity-timeout": "30m"},
+			HaproxyStickiness{Mode: "source", Expire: "30m"}, false},
+		{"invalid source timeout", v1.ServiceSpec{}, map[string]string{"session-affinity": "source", "session-affinity-timeout": "30 minutes"},
+			HaproxyStickiness{}, true},
+		{"invalid mode", v1.ServiceSpec{}, map[string]string{"session-affinity": "ip"}, HaproxyStickiness{}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			service := serviceWrapper(v1.Service{Spec: test.spec})
+			stickiness, err := serviceStickiness(service, func(name string) string { return test.annotations[name] })
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", stickiness)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stickiness != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, stickiness)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package haproxyconfigurator
+
+import (
+	"errors"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// backendTargetsNodePort sends traffic to the service's NodePort on every selected node
+	backendTargetsNodePort = "nodeport"
+	// backendTargetsEndpoints sends traffic straight to the pods backing the service
+	backendTargetsEndpoints = "endpoints"
+)
+
+const (
+	// localTrafficEndpointNodes only targets nodes hosting a ready endpoint
+	localTrafficEndpointNodes = "endpoint-nodes"
+	// localTrafficHealthCheck targets every node and lets the healthCheckNodePort pull nodes without endpoints
+	localTrafficHealthCheck = "health-check"
+)
+
+func validBackendTargets(targets string) bool {
+	return targets == backendTargetsNodePort || targets == backendTargetsEndpoints
+}
+
+// backendTargetsMode returns how the port's backends are reached
+func (s serviceWrapper) backendTargetsMode(p servicePortWrapper, options GeneratorOptions) string {
+	if targets := s.anno(p, "backend-targets"); targets != "" {
+		return targets
+	}
+	if options.BackendTargets != "" {
+		return options.BackendTargets
+	}
+	return backendTargetsNodePort
+}
+
+// localTrafficPolicy returns how nodes without local endpoints are avoided for services
+// with externalTrafficPolicy Local, or "" when the service uses the Cluster policy
+func (s serviceWrapper) localTrafficPolicy(p servicePortWrapper) (string, error) {
+	if s.Spec.ExternalTrafficPolicy != v1.ServiceExternalTrafficPolicyTypeLocal {
+		return "", nil
+	}
+	switch policy := s.anno(p, "local-traffic-policy"); policy {
+	case "", localTrafficEndpointNodes:
+		return localTrafficEndpointNodes, nil
+	case localTrafficHealthCheck:
+		if s.Spec.HealthCheckNodePort == 0 {
+			return "", errors.New("local-traffic-policy '" + localTrafficHealthCheck + "' requires a healthCheckNodePort")
+		}
+		return localTrafficHealthCheck, nil
+	default:
+		return "", errors.New("Invalid local-traffic-policy (" + policy + ") specified - valid options '" + localTrafficEndpointNodes + "', '" + localTrafficHealthCheck + "'")
+	}
+}
+
+// serviceDependsOnEndpoints reports whether the backends of any port of the service are derived from its endpoints
+func serviceDependsOnEndpoints(service serviceWrapper, options GeneratorOptions) bool {
+	for _, p := range service.Spec.Ports {
+		port := servicePortWrapper(p)
+		if service.backendTargetsMode(port, options) == backendTargetsEndpoints {
+			return true
+		}
+		if policy, _ := service.localTrafficPolicy(port); policy == localTrafficEndpointNodes {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceHealthCheck returns how haproxy checks the port's backend servers, starting from the
+// health-check-* annotations read through anno
+func serviceHealthCheck(service serviceWrapper, port servicePortWrapper, options GeneratorOptions, anno func(name string) string) (HaproxyHealthCheck, error) {
+	healthCheck, err := parseHealthCheck(anno)
+	if err != nil || service.backendTargetsMode(port, options) != backendTargetsNodePort {
+		return healthCheck, err
+	}
+	// kube-proxy answers on the healthCheckNodePort with 200 only on nodes hosting a local endpoint
+	if policy, _ := service.localTrafficPolicy(port); policy == localTrafficHealthCheck {
+		if healthCheck.HTTPPath != "" || healthCheck.Port != 0 {
+			return healthCheck, errors.New("health-check-path and health-check-port cannot be combined with local-traffic-policy '" + localTrafficHealthCheck + "'")
+		}
+		healthCheck.Port = service.Spec.HealthCheckNodePort
+		healthCheck.HTTPPath = "/healthz"
+		healthCheck.PlainText = true
+	}
+	return healthCheck, nil
+}
+
+// serviceBackendTargets lists the servers haproxy should send the port's traffic to
+func serviceBackendTargets(cache *kubernetesCache, nodes kubernetesNodes, service serviceWrapper, port servicePortWrapper, options GeneratorOptions) ([]HaproxyBackendTarget, error) {
+	switch mode := service.backendTargetsMode(port, options); mode {
+	case backendTargetsNodePort:
+		return nodePortTargets(cache, nodes, service, port)
+	case backendTargetsEndpoints:
+		return endpointTargets(cache, service, port)
+	default:
+		return nil, errors.New("Invalid backend-targets (" + mode + ") specified - valid options '" + backendTargetsNodePort + "', '" + backendTargetsEndpoints + "'")
+	}
+}
+
+func nodePortTargets(cache *kubernetesCache, nodes kubernetesNodes, service serviceWrapper, port servicePortWrapper) ([]HaproxyBackendTarget, error) {
+	if port.NodePort == 0 {
+		return nil, errors.New("Service port " + service.portLabel(port) + " has no NodePort")
+	}
+
+	// Narrow the backend nodes down with the service's own node selector
+	var serviceNodes = nodes
+	if nodeSelector, exists := service.annoExists(port, "node-selector"); exists {
+		selector, err := labels.Parse(nodeSelector)
+		if err != nil {
+			return nil, errors.New("Invalid node-selector (" + nodeSelector + "): " + err.Error())
+		}
+		serviceNodes = serviceNodes.matching(selector)
+	}
+
+	// Nodes without a local endpoint drop traffic for services with externalTrafficPolicy Local
+	policy, err := service.localTrafficPolicy(port)
+	if err != nil {
+		return nil, err
+	}
+	if policy == localTrafficEndpointNodes {
+		serviceNodes = serviceNodes.named(endpointNodeNames(cache, service, port))
+	}
+
+	var targets = []HaproxyBackendTarget{}
+	for hostname, node := range serviceNodes {
+		targets = append(targets, HaproxyBackendTarget{
+			Name: hostname,
+			IP:   node.IP,
+			Port: port.NodePort,
+		})
+	}
+	return targets, nil
+}
+
+func endpointTargetName(address v1.EndpointAddress) string {
+	if address.TargetRef != nil && address.TargetRef.Kind == "Pod" {
+		return address.TargetRef.Name
+	}
+	return address.IP
+}
+
+// endpointNodeNames returns the names of the nodes hosting a ready endpoint for the port
+func endpointNodeNames(cache *kubernetesCache, service serviceWrapper, port servicePortWrapper) map[string]bool {
+	names := map[string]bool{}
+	endpoints, exists := cache.getEndpoints(service.Namespace, service.Name)
+	if !exists {
+		return names
+	}
+	for _, subset := range endpoints.Subsets {
+		for _, endpointPort := range subset.Ports {
+			if endpointPort.Name != port.Name {
+				continue
+			}
+			for _, address := range subset.Addresses {
+				if address.NodeName != nil {
+					names[*address.NodeName] = true
+				}
+			}
+		}
+	}
+	return names
+}
+
+func endpointTargets(cache *kubernetesCache, service serviceWrapper, port servicePortWrapper) ([]HaproxyBackendTarget, error) {
+	var notReadyAsBackup = false
+	switch notReady := service.anno(port, "not-ready-endpoints"); notReady {
+	case "", "exclude":
+	case "backup":
+		notReadyAsBackup = true
+	default:
+		return nil, errors.New("Invalid not-ready-endpoints (" + notReady + ") specified - valid options 'exclude', 'backup'")
+	}
+
+	var targets = []HaproxyBackendTarget{}
+	endpoints, exists := cache.getEndpoints(service.Namespace, service.Name)
+	if !exists {
+		logger.Warnf("No endpoints found for service %s/%s", service.Namespace, service.Name)
+		return targets, nil
+	}
+	for _, subset := range endpoints.Subsets {
+		for _, endpointPort := range subset.Ports {
+			if endpointPort.Name != port.Name {
+				continue
+			}
+			for _, address := range subset.Addresses {
+				targets = append(targets, HaproxyBackendTarget{
+					Name: endpointTargetName(address),
+					IP:   address.IP,
+					Port: endpointPort.Port,
+				})
+			}
+			if notReadyAsBackup {
+				for _, address := range subset.NotReadyAddresses {
+					targets = append(targets, HaproxyBackendTarget{
+						Name:   endpointTargetName(address),
+						IP:     address.IP,
+						Port:   endpointPort.Port,
+						Backup: true,
+					})
+				}
+			}
+		}
+	}
+	return targets, nil
+}
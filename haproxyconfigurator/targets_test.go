@@ -0,0 +1,153 @@
+package haproxyconfigurator
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testEndpointAddress is a pod endpoint running on the node
+func testEndpointAddress(ip string, pod string, node string) v1.EndpointAddress {
+	return v1.EndpointAddress{IP: ip, NodeName: &node, TargetRef: &v1.ObjectReference{Kind: "Pod", Name: pod}}
+}
+
+// testEndpoints has web-1 ready on node-1, web-2 not ready on node-2 and an address without pod ready
+func testEndpoints() *v1.Endpoints {
+	return &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses:         []v1.EndpointAddress{testEndpointAddress("10.1.0.1", "web-1", "node-1")},
+				NotReadyAddresses: []v1.EndpointAddress{testEndpointAddress("10.1.0.2", "web-2", "node-2")},
+				Ports:             []v1.EndpointPort{{Name: "http", Port: 8080}, {Name: "metrics", Port: 9090}},
+			},
+			{
+				Addresses: []v1.EndpointAddress{{IP: "10.1.0.3"}},
+				Ports:     []v1.EndpointPort{{Name: "http", Port: 8080}},
+			},
+		},
+	}
+}
+
+func TestEndpointTargets(t *testing.T) {
+	port := servicePortWrapper(v1.ServicePort{Name: "http", Port: 80})
+	for _, test := range []struct {
+		name      string
+		notReady  string
+		endpoints bool
+		expected  []HaproxyBackendTarget
+		invalid   bool
+	}{
+		{"ready by default", "", true, []HaproxyBackendTarget{
+			{Name: "web-1", IP: "10.1.0.1", Port: 8080},
+			{Name: "10.1.0.3", IP: "10.1.0.3", Port: 8080},
+		}, false},
+		{"exclude", "exclude", true, []HaproxyBackendTarget{
+			{Name: "web-1", IP: "10.1.0.1", Port: 8080},
+			{Name: "10.1.0.3", IP: "10.1.0.3", Port: 8080},
+		}, false},
+		{"backup", "backup", true, []HaproxyBackendTarget{
+			{Name: "web-1", IP: "10.1.0.1", Port: 8080},
+			{Name: "web-2", IP: "10.1.0.2", Port: 8080, Backup: true},
+			{Name: "10.1.0.3", IP: "10.1.0.3", Port: 8080},
+		}, false},
+		{"invalid", "include", true, nil, true},
+		{"no endpoints", "", false, []HaproxyBackendTarget{}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			service := serviceWrapper(v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Annotations: map[string]string{}}})
+			if test.notReady != "" {
+				service.Annotations[port.annoName("not-ready-endpoints")] = test.notReady
+			}
+			cache := newTestCache(t)
+			if test.endpoints {
+				cache = newTestCache(t, testEndpoints())
+			}
+			targets, err := endpointTargets(cache, service, port)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", targets)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(targets, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, targets)
+			}
+		})
+	}
+}
+
+func TestNodePortTargets(t *testing.T) {
+	port := servicePortWrapper(v1.ServicePort{Name: "http", Port: 80, NodePort: 30080})
+	nodes := kubernetesNodes{
+		"node-1": {IP: "10.0.0.1", Labels: map[string]string{"zone": "a"}},
+		"node-2": {IP: "10.0.0.2", Labels: map[string]string{"zone": "a"}},
+		"node-3": {IP: "10.0.0.3", Labels: map[string]string{"zone": "b"}},
+	}
+	every := []HaproxyBackendTarget{
+		{Name: "node-1", IP: "10.0.0.1", Port: 30080},
+		{Name: "node-2", IP: "10.0.0.2", Port: 30080},
+		{Name: "node-3", IP: "10.0.0.3", Port: 30080},
+	}
+	for _, test := range []struct {
+		name                string
+		policy              v1.ServiceExternalTrafficPolicyType
+		healthCheckNodePort int32
+		annotations         map[string]string
+		endpoints           *v1.Endpoints
+		expected            []HaproxyBackendTarget
+		invalid             bool
+	}{
+		{"cluster", v1.ServiceExternalTrafficPolicyTypeCluster, 0, nil, testEndpoints(), every, false},
+		{"local", v1.ServiceExternalTrafficPolicyTypeLocal, 0, nil, testEndpoints(),
+			[]HaproxyBackendTarget{{Name: "node-1", IP: "10.0.0.1", Port: 30080}}, false},
+		{"local endpoint-nodes", v1.ServiceExternalTrafficPolicyTypeLocal, 0, map[string]string{"local-traffic-policy": "endpoint-nodes"}, testEndpoints(),
+			[]HaproxyBackendTarget{{Name: "node-1", IP: "10.0.0.1", Port: 30080}}, false},
+		{"local without local endpoints", v1.ServiceExternalTrafficPolicyTypeLocal, 0, nil, &v1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+			Subsets: []v1.EndpointSubset{{
+				Addresses:         []v1.EndpointAddress{{IP: "10.1.0.3"}},
+				NotReadyAddresses: []v1.EndpointAddress{testEndpointAddress("10.1.0.2", "web-2", "node-2")},
+				Ports:             []v1.EndpointPort{{Name: "http", Port: 8080}},
+			}},
+		}, []HaproxyBackendTarget{}, false},
+		{"local without endpoints", v1.ServiceExternalTrafficPolicyTypeLocal, 0, nil, nil, []HaproxyBackendTarget{}, false},
+		{"local with node selector", v1.ServiceExternalTrafficPolicyTypeLocal, 0, map[string]string{"node-selector": "zone=b"}, testEndpoints(),
+			[]HaproxyBackendTarget{}, false},
+		{"local health-check", v1.ServiceExternalTrafficPolicyTypeLocal, 32000, map[string]string{"local-traffic-policy": "health-check"}, testEndpoints(), every, false},
+		{"local health-check without healthCheckNodePort", v1.ServiceExternalTrafficPolicyTypeLocal, 0, map[string]string{"local-traffic-policy": "health-check"}, testEndpoints(), nil, true},
+		{"invalid local-traffic-policy", v1.ServiceExternalTrafficPolicyTypeLocal, 0, map[string]string{"local-traffic-policy": "nearest"}, testEndpoints(), nil, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			service := serviceWrapper(v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Annotations: map[string]string{}},
+				Spec: v1.ServiceSpec{ExternalTrafficPolicy: test.policy, HealthCheckNodePort: test.healthCheckNodePort}})
+			for name, value := range test.annotations {
+				service.Annotations[port.annoName(name)] = value
+			}
+			cache := newTestCache(t)
+			if test.endpoints != nil {
+				cache = newTestCache(t, test.endpoints)
+			}
+			targets, err := nodePortTargets(cache, nodes, service, port)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", targets)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+			if !reflect.DeepEqual(targets, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, targets)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package haproxyconfigurator
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// DefaultTemplate renders the configuration exactly like the built-in renderer
+const DefaultTemplate = "{{ .ConfigFile }}"
+
+// TemplateData is the desired state handed to configuration templates
+type TemplateData struct {
+	// Version is the targeted haproxy version, e.g. {{ if .Version.AtLeast 2 2 }}
+	Version   HaproxyVersion
+	Listeners []TemplateListener
+	// Userlists holds the users of basic authentication, by name
+	Userlists []*HaproxyUserlist
+	// Backends holds every backend once, in the order the built-in renderer writes them
+	Backends []*HaproxyBackend
+	// ConfigFile is the configuration the built-in renderer would write
+	ConfigFile *HaproxyConfigFile
+}
+
+// TemplateListener is a frontend listening on one IP and port
+type TemplateListener struct {
+	Name         string
+	IP           string
+	Port         uint16
+	Mode         string
+	UseSSL       bool
+	Certificates []string
+	// CrtList is the crt-list file serving the certificates by SNI
+	CrtList string
+	// SSLOptions are the bind arguments of the default TLS policy, e.g. "ssl-min-ver TLSv1.2"
+	SSLOptions string
+	// SNIPassthrough routes 'tcp' mode connections by the SNI of their TLS client hello, the route hostname
+	SNIPassthrough bool
+	// Routes are in matching order: by hostname, then path regexes, longest path prefixes and no path
+	Routes []TemplateRoute
+	// Redirects are the hostnames redirected to HTTPS, sorted
+	Redirects []TemplateRedirect
+	// ClientVerifications are the hostnames verifying client certificates, sorted
+	ClientVerifications []TemplateClientVerification
+}
+
+// TemplateClientVerification only accepts requests for a hostname through its own SNI, where the
+// client certificate was verified
+type TemplateClientVerification struct {
+	Hostname string
+	// DNHeader is the request header passing the client certificate subject, or empty
+	DNHeader string
+}
+
+// TemplateRedirect sends plain HTTP requests for a hostname to the HTTPS port
+type TemplateRedirect struct {
+	Hostname  string
+	HTTPSPort uint16
+}
+
+// TemplateRoute sends requests for a hostname and optional path to a backend
+type TemplateRoute struct {
+	Hostname   string
+	PathPrefix string
+	PathRegex  string
+	Backend    *HaproxyBackend
+	// AllowCIDRs and DenyCIDRs restrict the client IPs of the route
+	AllowCIDRs []string
+	DenyCIDRs  []string
+	// BasicAuth is the required authentication, or nil
+	BasicAuth *HaproxyBasicAuth
+}
+
+// templateFuncs is the helper library available to configuration templates
+var templateFuncs = template.FuncMap{
+	"join":       strings.Join,
+	"split":      strings.Split,
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"replace":    strings.Replace,
+	"contains":   strings.Contains,
+	"hasPrefix":  strings.HasPrefix,
+	"hasSuffix":  strings.HasSuffix,
+	"trimPrefix": strings.TrimPrefix,
+	"trimSuffix": strings.TrimSuffix,
+	"itoa":       strconv.Itoa,
+	"default": func(fallback string, value string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	},
+	"indent": func(spaces int, text string) string {
+		padding := strings.Repeat(" ", spaces)
+		return padding + strings.Replace(text, "\n", "\n"+padding, -1)
+	},
+}
+
+func parseConfigTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+// loadConfigTemplate parses a configuration template file
+func loadConfigTemplate(path string) (*template.Template, error) {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigTemplate(filepath.Base(path), string(text))
+}
+
+// TemplateData collects the desired state for configuration templates
+func (h *HaproxyConfigurator) TemplateData() TemplateData {
+	var data = TemplateData{Version: h.Version, Userlists: h.sortedUserlists(), ConfigFile: h.ConfigFile()}
+	var seenBackends = map[string]bool{}
+	for _, listenIP := range h.sortedListenIPs() {
+		innerMap := h.desiredConfig.listenIPs[listenIP]
+		for _, port := range sortListenerMap(innerMap) {
+			listener := innerMap[port]
+			templateListener := TemplateListener{
+				Name:           listener.name,
+				IP:             listenIP,
+				Port:           port,
+				Mode:           listener.mode,
+				UseSSL:         listener.useSSL,
+				Certificates:   listener.certificatePaths(),
+				SNIPassthrough: listener.sniPassthrough,
+			}
+			if listener.useSSL {
+				templateListener.CrtList = h.crtListPath(listener)
+				templateListener.SSLOptions = strings.Join(h.SSLDefaults.arguments(), " ")
+			}
+			for _, hostname := range sortedCertificateHostnames(listener.certificates) {
+				if listener.certificates[hostname].Options.CAFile != "" {
+					templateListener.ClientVerifications = append(templateListener.ClientVerifications, TemplateClientVerification{
+						Hostname: hostname,
+						DNHeader: listener.clientDNHeaders[hostname],
+					})
+				}
+			}
+			for _, hostname := range sortedRedirects(listener.redirects) {
+				templateListener.Redirects = append(templateListener.Redirects, TemplateRedirect{
+					Hostname:  hostname,
+					HTTPSPort: listener.redirects[hostname],
+				})
+			}
+			for _, route := range sortBackendMap(listener.routeBackends) {
+				backend := listener.routeBackends[route]
+				templateListener.Routes = append(templateListener.Routes, TemplateRoute{
+					Hostname:   route.hostname,
+					PathPrefix: route.pathPrefix,
+					PathRegex:  route.pathRegex,
+					Backend:    backend,
+					AllowCIDRs: listener.accessLists[route].allow,
+					DenyCIDRs:  listener.accessLists[route].deny,
+					BasicAuth:  listener.basicAuth[route],
+				})
+				if !seenBackends[backend.Name] {
+					seenBackends[backend.Name] = true
+					data.Backends = append(data.Backends, backend)
+				}
+			}
+			data.Listeners = append(data.Listeners, templateListener)
+		}
+	}
+	return data
+}
+
+// RenderTemplate renders the haproxy configuration through a template
+func (h *HaproxyConfigurator) RenderTemplate(tmpl *template.Template) (string, error) {
+	var config bytes.Buffer
+	if err := tmpl.Execute(&config, h.TemplateData()); err != nil {
+		return "", err
+	}
+	return config.String(), nil
+}
@@ -0,0 +1,102 @@
+package haproxyconfigurator
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTemplateRedirects(t *testing.T) {
+	h := newTestConfigurator(t, "2.0")
+	otherPort := testHTTPSRoute("www.example.com", "www")
+	otherPort.Name, otherPort.ListenPort = listenerName("*", 8443), 8443
+	addTestListeners(t, h, testHTTPSRoute("shop.example.com", "shop"), otherPort)
+
+	var redirects = map[uint16][]TemplateRedirect{}
+	for _, listener := range h.TemplateData().Listeners {
+		redirects[listener.Port] = listener.Redirects
+	}
+	expected := map[uint16][]TemplateRedirect{
+		80:   {{Hostname: "shop.example.com", HTTPSPort: 443}, {Hostname: "www.example.com", HTTPSPort: 8443}},
+		443:  nil,
+		8443: nil,
+	}
+	if !reflect.DeepEqual(redirects, expected) {
+		t.Errorf("expected redirects %+v, got %+v", expected, redirects)
+	}
+}
+
+func TestDefaultTemplate(t *testing.T) {
+	tmpl, err := parseConfigTemplate("default", DefaultTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fixture := range renderFixtures() {
+		t.Run(fixture.name, func(t *testing.T) {
+			h := newTestConfigurator(t, fixture.version)
+			addTestListeners(t, h, fixture.listeners...)
+			rendered, err := h.RenderTemplate(tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := h.Render(); rendered != expected {
+				t.Errorf("expected the built-in configuration\n%s\ngot\n%s", expected, rendered)
+			}
+		})
+	}
+}
+
+func TestTemplateListenerFields(t *testing.T) {
+	h := newTestConfigurator(t, "2.0")
+	h.SSLDefaults = HaproxySSLOptions{ALPN: "h2,http/1.1"}
+	users := &HaproxyUserlist{Name: "k8s-secret_default_users_users", Users: []HaproxyUser{{Name: "alice", Password: "rl0uE5SKpKQvA"}}}
+	shop := testHTTPSRoute("shop.example.com", "shop")
+	shop.SslOptions = HaproxySSLOptions{Verify: "required", CAFile: "/etc/haproxy/ssl/ca.pem"}
+	shop.ClientDNHeader = "X-Client-DN"
+	shop.AllowCIDRs = []string{"10.0.0.0/8"}
+	shop.DenyCIDRs = []string{"10.1.0.0/16"}
+	shop.BasicAuth = &HaproxyBasicAuth{Realm: "Shop", Userlist: users}
+	addTestListeners(t, h, shop)
+
+	data := h.TemplateData()
+	shopBackend := testBackend("shop", 30443)
+	expected := []TemplateListener{
+		{
+			Name:         listenerName("*", 80),
+			IP:           "*",
+			Port:         80,
+			Mode:         "http",
+			Certificates: []string{},
+			Redirects:    []TemplateRedirect{{Hostname: "shop.example.com", HTTPSPort: 443}},
+		},
+		{
+			Name:         listenerName("*", 443),
+			IP:           "*",
+			Port:         443,
+			Mode:         "http",
+			UseSSL:       true,
+			Certificates: []string{"/etc/haproxy/ssl/shop.example.com.pem"},
+			CrtList:      "/etc/haproxy/ssl/" + listenerName("*", 443) + crtListExtension,
+			SSLOptions:   "alpn h2,http/1.1",
+			Routes: []TemplateRoute{{
+				Hostname:   "shop.example.com",
+				Backend:    &shopBackend,
+				AllowCIDRs: []string{"10.0.0.0/8"},
+				DenyCIDRs:  []string{"10.1.0.0/16"},
+				BasicAuth:  &HaproxyBasicAuth{Realm: "Shop", Userlist: users},
+			}},
+			ClientVerifications: []TemplateClientVerification{{Hostname: "shop.example.com", DNHeader: "X-Client-DN"}},
+		},
+	}
+	if !reflect.DeepEqual(data.Listeners, expected) {
+		t.Errorf("expected listeners\n%+v\ngot\n%+v", expected, data.Listeners)
+	}
+	if !reflect.DeepEqual(data.Userlists, []*HaproxyUserlist{users}) {
+		t.Errorf("expected the userlist %s, got %+v", users.Name, data.Userlists)
+	}
+	if !reflect.DeepEqual(data.Backends, []*HaproxyBackend{&shopBackend}) {
+		t.Errorf("expected the backend %s, got %+v", shopBackend.Name, data.Backends)
+	}
+	if data.Version != h.Version || data.ConfigFile.String() != h.Render() {
+		t.Error("expected the targeted version and the built-in configuration")
+	}
+}
@@ -0,0 +1,75 @@
+package haproxyconfigurator
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// haproxyTimePattern matches haproxy time values like "500ms", "2s" or "1m"; a bare number is milliseconds
+var haproxyTimePattern = regexp.MustCompile(`^([0-9]+)(us|ms|s|m|h|d)?$`)
+
+// haproxyTimeUnits are the durations of the haproxy time units
+var haproxyTimeUnits = map[string]time.Duration{
+	"":   time.Millisecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+}
+
+// maxHaproxyTime is the longest timer haproxy accepts, 2^31-1 milliseconds
+const maxHaproxyTime = 2147483647 * time.Millisecond
+
+// validateHaproxyTime checks the annotation holds a haproxy time between 1ms and about 24 days
+func validateHaproxyTime(name string, value string) error {
+	match := haproxyTimePattern.FindStringSubmatch(value)
+	if match == nil {
+		return errors.New("Invalid " + name + " (" + value + ") specified - expected a time like '30s' or '500ms'")
+	}
+	count, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil || count > int64(maxHaproxyTime/haproxyTimeUnits[match[2]]) {
+		return errors.New("Invalid " + name + " (" + value + ") specified - it cannot be longer than 24 days")
+	}
+	if duration := time.Duration(count) * haproxyTimeUnits[match[2]]; duration < time.Millisecond {
+		return errors.New("Invalid " + name + " (" + value + ") specified - it must be at least 1ms")
+	}
+	return nil
+}
+
+// parseTimeouts reads the timeout-* annotations of a service port or ingress
+func parseTimeouts(anno func(name string) string) (HaproxyTimeouts, error) {
+	var timeouts = HaproxyTimeouts{
+		Server: anno("timeout-server"),
+		Tunnel: anno("timeout-tunnel"),
+		Queue:  anno("timeout-queue"),
+	}
+	for _, timeout := range []struct{ name, value string }{
+		{"timeout-server", timeouts.Server},
+		{"timeout-tunnel", timeouts.Tunnel},
+		{"timeout-queue", timeouts.Queue},
+	} {
+		if timeout.value == "" {
+			continue
+		}
+		if err := validateHaproxyTime(timeout.name, timeout.value); err != nil {
+			return timeouts, err
+		}
+	}
+	return timeouts, nil
+}
+
+// parseMaxConn reads the backends-maxconn annotation, the concurrent connections allowed per server
+func parseMaxConn(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	maxConn, err := strconv.Atoi(value)
+	if err != nil || maxConn < 1 || maxConn > 1000000 {
+		return 0, errors.New("Invalid backends-maxconn (" + value + ") specified - expected a number of connections between 1 and 1000000")
+	}
+	return maxConn, nil
+}
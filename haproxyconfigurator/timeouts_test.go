@@ -0,0 +1,67 @@
+package haproxyconfigurator
+
+import "testing"
+
+func TestValidateHaproxyTime(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		valid bool
+	}{
+		{"500", true},
+		{"500ms", true},
+		{"30s", true},
+		{"5m", true},
+		{"1h", true},
+		{"24d", true},
+		{"1000us", true},
+		{"999us", false},
+		{"0", false},
+		{"25d", false},
+		{"2147483647", true},
+		{"2147483648", false},
+		{"99999999999999999999", false},
+		{"", false},
+		{"30 s", false},
+		{"-1s", false},
+		{"1.5s", false},
+		{"30sec", false},
+	} {
+		err := validateHaproxyTime("timeout-server", test.value)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: expected valid %v, got %v", test.value, test.valid, err)
+		}
+	}
+}
+
+func TestParseTimeouts(t *testing.T) {
+	timeouts, err := parseTimeouts(annotations(map[string]string{"timeout-server": "30s", "timeout-tunnel": "1h"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (HaproxyTimeouts{Server: "30s", Tunnel: "1h"}); timeouts != expected {
+		t.Errorf("expected %+v, got %+v", expected, timeouts)
+	}
+	if _, err := parseTimeouts(annotations(map[string]string{"timeout-queue": "forever"})); err == nil {
+		t.Error("expected an error for timeout-queue 'forever'")
+	}
+}
+
+func TestParseMaxConn(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected int
+		invalid  bool
+	}{
+		{"", 0, false},
+		{"1", 1, false},
+		{"1000000", 1000000, false},
+		{"0", 0, true},
+		{"1000001", 0, true},
+		{"many", 0, true},
+	} {
+		maxConn, err := parseMaxConn(test.value)
+		if (err != nil) != test.invalid || maxConn != test.expected {
+			t.Errorf("%q: expected %d (invalid %v), got %d (%v)", test.value, test.expected, test.invalid, maxConn, err)
+		}
+	}
+}